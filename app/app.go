@@ -3,388 +3,207 @@ package app
 import (
 	"fmt"
 	"log"
-	"path/filepath"
-	"sort"
+	"os"
+	"slices"
 	"strings"
-	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
 
+	"dup/bus"
+	"dup/engine"
 	"dup/fs"
+	"dup/guard"
 	"dup/lifecycle"
+	"dup/plan"
 )
 
-func Run(fss []fs.FS, lc *lifecycle.Lifecycle) {
-	m := make(model, 1)
-	p := tea.NewProgram(m)
-
-	archives := make([]*archive, len(fss))
-	for i, fs := range fss {
-		archives[i] = &archive{fs: fs, files: map[string]*file{}}
-	}
-
-	app := &app{
-		archives:        archives,
-		lc:              lc,
-		events:          events{p},
-		backup:          time.Now().Format("~~~060102-150405~~~"),
-		syncingArchives: len(archives) - 1,
-	}
-
-	for _, fs := range fss {
-		fs.Scan(app.events)
-	}
-
-	m <- app
+// Run syncs the archives in a full-screen interface; a plan that exceeds the limits needs
+// the user's confirmation. It returns the executed plan, if any, and whether it ran to the end without failures.
+func Run(fss []fs.FS, lc *lifecycle.Lifecycle, opts plan.Options, limits guard.Limits) (*plan.Plan, bool) {
+	e := engine.New(fss, lc)
+	program := tea.NewProgram(model{engine: e}, tea.WithAltScreen())
+	e.Subscribe(bus.SinkFunc(func(event any) {
+		if progress, ok := event.(engine.Progress); ok {
+			program.Send(progress)
+		}
+	}))
+	e.Subscribe(bus.SinkFunc(engine.LogEvent))
+
+	planned := make(chan *plan.Plan, 1)
+	executed := make(chan bool, 1)
+	refused := make(chan error, 1)
+	synced := make(chan []fs.Fingerprint, 1)
+	go func() {
+		if !e.Scan() {
+			return
+		}
+		opts.Speeds = e.Speeds()
+		p := e.Plan(opts)
+		if !p.Identical() {
+			trips := guard.Check(p, limits)
+			decision := make(chan *plan.Plan, 1)
+			program.Send(reviewMsg{plan: p, opts: opts, snapshots: e.Snapshots(), limits: limits, trips: trips, decision: decision})
+			select {
+			case p = <-decision:
+			case <-e.Done():
+				return
+			}
+			if p == nil {
+				e.Stop()
+				return
+			}
+		}
+		planned <- p
+		ok, err := e.Execute(p)
+		if err != nil {
+			refused <- err
+		}
+		synced <- e.Fingerprints()
+		executed <- ok
+		if ok || err != nil {
+			e.Stop()
+		}
+	}()
 
-	if _, err := p.Run(); err != nil {
+	final, err := program.Run()
+	if err != nil {
 		log.Fatal(err)
 	}
-}
+	e.Stop()
 
-type events struct {
-	p *tea.Program
+	select {
+	case p := <-planned:
+		ok := <-executed
+		select {
+		case err := <-refused:
+			fmt.Fprintf(os.Stderr, "dup: %v\n", err)
+			return nil, false
+		default:
+		}
+		printFingerprints(p, <-synced)
+		failed := 0
+		for _, archive := range final.(model).progress.Archives {
+			failed += archive.Failed
+		}
+		return p, ok && failed == 0
+	default:
+	}
+	return nil, false
 }
 
-func (e events) Send(event any) {
-	e.p.Send(event)
+type model struct {
+	engine       *engine.Engine
+	progress     engine.Progress
+	review       *review
+	screenWidth  int
+	screenHeight int
 }
 
-type model chan *app
-
 func (m model) Init() tea.Cmd {
 	return nil
 }
 
 func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
-	app := <-m
-	defer func() { m <- app }()
-
-	if app.state == appDone {
-		return m, tea.Quit
-	}
-
 	switch msg := msg.(type) {
 	case tea.WindowSizeMsg:
-		app.screenWidth = msg.Width
-
-	case tea.KeyMsg:
-		switch msg.String() {
-		case "esc":
-			go func() {
-				app.lc.Stop()
-				app.state = appDone
-				app.events.Send("trigger update")
-			}()
-			return m, nil
-		}
-
-	case fs.FileMetas:
-		archive := app.archives[msg.Idx]
-		for _, meta := range msg.Metas {
-			archive.files[meta.Path] = &file{
-				path:    meta.Path,
-				size:    meta.Size,
-				modTime: meta.ModTime,
-				hash:    meta.Hash,
-			}
-			if meta.Hash == "" {
-				archive.size++
-			}
+		m.screenWidth = msg.Width
+		m.screenHeight = msg.Height
+		if m.review != nil {
+			m.review.scroll(m.screenHeight)
 		}
 
-	case fs.FileHashed:
-		archive := app.archives[msg.Idx]
-		file := archive.findFile(msg.Path)
-		file.hash = msg.Hash
-		archive.done++
-		archive.state = hashing
+	case reviewMsg:
+		m.review = newReview(msg)
+		m.review.scroll(m.screenHeight)
 
-	case fs.ArchiveHashed:
-		archive := app.archives[msg.Idx]
-		archive.state = hashed
-		allHashed := true
-		for _, archive := range app.archives {
-			if archive.state != hashed {
-				allHashed = false
-			}
-		}
-		if allHashed {
-			app.analyzeArchives()
-			app.state = appRenaming
-			for _, archive := range app.archives[1:] {
-				archive.done = 0
-				archive.size = len(archive.commands)
-				archive.fs.Sync(archive.commands, app.events)
+	case tea.KeyMsg:
+		if m.review != nil {
+			cmd, done := m.review.update(msg, m.screenHeight)
+			if done {
+				m.review = nil
 			}
+			return m, cmd
 		}
-
-	case fs.RenamingFile:
-		archive := app.archives[msg.Idx]
-		archive.done++
-
-	case fs.CopyingFile:
-		archive := app.archives[msg.Idx]
-		archive.done += msg.Size
-		file := archive.files[msg.Path]
-		if archive.filePath != file.path {
-			archive.filePath = file.path
-			archive.fileSize = file.size
-			archive.fileCopyed = msg.Size
-		} else {
-			archive.fileCopyed += msg.Size
-			if archive.fileCopyed >= file.size {
-				archive.fileCopyed = file.size
-				archive.done += file.size - archive.fileCopyed
+		switch msg.String() {
+		case "esc":
+			return m, func() tea.Msg {
+				m.engine.Stop()
+				return nil
 			}
 		}
 
-	case fs.Synced:
-		if app.state == appCopying {
-			app.lc.Stop()
-			app.state = appDone
-			return m, func() tea.Msg { return "trigger update" }
-
-		}
-		app.syncingArchives--
-		if app.syncingArchives == 0 {
-			archive := app.archives[0]
-			for _, cmd := range archive.commands {
-				path := cmd.(fs.Copy).Path
-				file := archive.files[path]
-				archive.size += file.size
-			}
-			archive.done = 0
-			app.state = appCopying
-			archive.fs.Sync(archive.commands, app.events)
+	case engine.Progress:
+		m.progress = msg
+		if msg.State == engine.Done {
+			return m, tea.Quit
 		}
 	}
 	return m, nil
 }
 
 func (m model) View() string {
-	app := <-m
+	if m.review != nil {
+		return m.review.view(m.screenWidth, m.screenHeight)
+	}
 	b := strings.Builder{}
-	switch app.state {
-	case appStarted:
-		for _, archive := range app.archives {
-			switch archive.state {
-			case scanning:
-				fmt.Fprintf(&b, "scanning            %s\n", archive.fs.Root())
-			case hashing:
-				fmt.Fprintf(&b, "hashing  %s %s\n", progressBar(archive.done, archive.size, 10), archive.fs.Root())
-			case hashed:
-				fmt.Fprintf(&b, "hashed              %s\n", archive.fs.Root())
+	switch m.progress.State {
+	case engine.Scanning:
+		for _, archive := range m.progress.Archives {
+			switch archive.State {
+			case engine.ArchiveScanning:
+				fmt.Fprintf(&b, "scanning            %s\n", archive.Root)
+			case engine.ArchiveHashing:
+				fmt.Fprintf(&b, "hashing  %s %s\n", progressBar(archive.Done, archive.Size, 10), archive.Root)
+			case engine.ArchiveHashed:
+				fmt.Fprintf(&b, "hashed              %s\n", archive.Root)
 			}
 		}
-	case appRenaming:
-		for i, archive := range app.archives {
-			if i == 0 {
-				fmt.Fprintf(&b, "waiting              %s\n", archive.fs.Root())
+	case engine.Renaming:
+		for _, archive := range m.progress.Archives {
+			if archive.State != engine.ArchiveRenaming && archive.State != engine.ArchiveSynced {
+				fmt.Fprintf(&b, "waiting             %s\n", archive.Root)
 				continue
 			}
-			fmt.Fprintf(&b, "renaming %s %s\n", progressBar(archive.done, archive.size, 10), archive.fs.Root())
+			fmt.Fprintf(&b, "renaming %s %s\n", progressBar(archive.Done, archive.Size, 10), archive.Root)
 		}
 
-	case appCopying:
-		archive := app.archives[0]
-		width := app.screenWidth - 9
-		fmt.Fprintf(&b, "Copying %s\n", progressBar(archive.done, archive.size, width))
-		fmt.Fprintf(&b, "   file %s %s\n", progressBar(archive.fileCopyed, archive.fileSize, 10), archive.filePath)
-	}
-	m <- app
-	return b.String()
-}
-
-func (app *app) analyzeArchives() {
-	app.ignoreIdenticalFiles()
-	app.backupExcessFiles()
-	app.resolveConflicts()
-	app.renameAndCopyFiles()
-
-	commands := app.archives[0].commands
-	sort.Slice(commands, func(i, j int) bool {
-		iCmd := commands[i].(fs.Copy)
-		jCmd := commands[j].(fs.Copy)
-		return iCmd.Path < jCmd.Path
-	})
-}
-
-func (app *app) ignoreIdenticalFiles() {
-	identicalFiles := []string{}
-	for _, original := range app.archives[0].files {
-		hasIdentical := true
-		for _, archive := range app.archives[1:] {
-			copy, ok := archive.files[original.path]
-			if !ok || original.size != copy.size || original.hash != copy.hash {
-				hasIdentical = false
+	case engine.Copying:
+		width := max(m.screenWidth-9, 10)
+		for _, archive := range m.progress.Archives {
+			if archive.State == engine.ArchiveRenaming {
+				fmt.Fprintf(&b, "renaming %s %s\n", progressBar(archive.Done, archive.Size, 10), archive.Root)
 			}
-		}
-		if hasIdentical {
-			identicalFiles = append(identicalFiles, original.path)
-		}
-	}
-	for _, archive := range app.archives {
-		for _, path := range identicalFiles {
-			delete(archive.files, path)
-		}
-	}
-}
-
-func (app *app) backupExcessFiles() {
-	hashes := map[string]struct{}{}
-	for _, archive := range app.archives {
-		for _, file := range archive.files {
-			hashes[file.hash] = struct{}{}
-		}
-	}
-
-	originals := app.archives[0].byHash()
-	for _, archive := range app.archives[1:] {
-		copies := archive.byHash()
-		for hash := range hashes {
-			originalFiles := originals[hash]
-			copyFiles := copies[hash]
-
-			if len(originalFiles) >= len(copyFiles) {
+			if archive.State != engine.ArchiveCopying {
 				continue
 			}
-			for i := len(originalFiles); i < len(copyFiles); i++ {
-				path := copyFiles[i]
-				archive.commands = append(archive.commands, fs.Rename{
-					SourcePath:      path,
-					DestinationPath: filepath.Join(app.backup, path),
-				})
-				delete(archive.files, path)
+			if archive.Failed > 0 {
+				fmt.Fprintf(&b, "Copying to %s, %d failed\n", archive.Root, archive.Failed)
+			} else {
+				fmt.Fprintf(&b, "Copying to %s\n", archive.Root)
 			}
+			fmt.Fprintf(&b, "        %s\n", progressBar(archive.Done, archive.Size, width))
+			fmt.Fprintf(&b, "   file %s %s\n", progressBar(archive.FileCopied, archive.FileSize, 10), archive.FilePath)
 		}
 	}
+	return b.String()
 }
 
-func (app *app) resolveConflicts() {
-	for _, file := range app.archives[0].files {
-		for _, archive := range app.archives[1:] {
-			if other, ok := archive.files[file.path]; ok {
-				if file.hash == other.hash {
-					continue
-				}
-				dir, name := filepath.Split(other.path)
-				newPath := filepath.Join(dir, app.backup+name)
-				archive.commands = append(archive.commands, fs.Rename{
-					SourcePath:      other.path,
-					DestinationPath: newPath,
-				})
-				other.path = newPath
-				archive.files[newPath] = other
-				delete(archive.files, file.path)
-			}
-		}
+// printFingerprints prints the fingerprints the archives have after the sync.
+func printFingerprints(p *plan.Plan, fingerprints []fs.Fingerprint) {
+	if len(fingerprints) == 0 {
+		return
 	}
-}
-
-func (app *app) renameAndCopyFiles() {
-	toCopy := map[string][]string{}
-	originalsByHash := app.archives[0].byHash()
-	for _, archive := range app.archives[1:] {
-		copiesByHash := archive.byHash()
-		for hash, originals := range originalsByHash {
-			copies := copiesByHash[hash]
-			for i, original := range originals {
-				if i < len(copies) {
-					archive.commands = append(archive.commands, fs.Rename{
-						SourcePath:      copies[i],
-						DestinationPath: original,
-					})
-				} else {
-					newRoots := toCopy[original]
-					newRoots = append(newRoots, archive.fs.Root())
-					toCopy[original] = newRoots
-				}
-			}
-		}
+	if !slices.ContainsFunc(fingerprints, func(fp fs.Fingerprint) bool { return fp != fingerprints[0] }) {
+		fmt.Printf("All archives are identical: %s (%d files)\n", fingerprints[0].Hash, fingerprints[0].Files)
+		return
 	}
-	for path, roots := range toCopy {
-		archive := app.archives[0]
-		if len(roots) > 0 {
-			archive.commands = append(archive.commands, fs.Copy{
-				Path:    path,
-				Hash:    archive.files[path].hash,
-				ToRoots: roots,
-			})
-		}
-
+	for i, archive := range p.Archives {
+		fp := fingerprints[i]
+		fmt.Printf("%s %8d files  %s\n", fp.Hash, fp.Files, archive.Root)
 	}
 }
 
-func (arc *archive) byHash() map[string][]string {
-	result := map[string][]string{}
-	for _, file := range arc.files {
-		paths := result[file.hash]
-		paths = append(paths, file.path)
-		result[file.hash] = paths
-	}
-	return result
-}
-
-type appState int
-
-const (
-	appStarted appState = iota
-	appRenaming
-	appCopying
-	appDone
-)
-
-type archiveState int
-
-const (
-	scanning archiveState = iota
-	hashing
-	hashed
-	renaming
-)
-
-type app struct {
-	state           appState
-	archives        []*archive
-	lc              *lifecycle.Lifecycle
-	events          events
-	backup          string
-	syncingArchives int
-	screenWidth     int
-}
-
-type archive struct {
-	state      archiveState
-	fs         fs.FS
-	files      files
-	commands   []any
-	size       int
-	done       int
-	filePath   string
-	fileSize   int
-	fileCopyed int
-}
-
-type file struct {
-	path    string
-	size    int
-	modTime time.Time
-	hash    string
-}
-
-type files map[string]*file
-
-func (arc *archive) findFile(path string) *file {
-	for _, file := range arc.files {
-		if file.path == path {
-			return file
-		}
-	}
-	return nil
-}
-
 var style = lipgloss.NewStyle().
 	Background(lipgloss.Color("#C0C0C0")).
 	Foreground(lipgloss.Color("#7D56F4"))
@@ -0,0 +1,242 @@
+package app
+
+import (
+	"fmt"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+
+	"dup/fs"
+	"dup/plan"
+)
+
+// conflicts lets the user decide, file by file, by pattern or for all files at once,
+// which version of a file that differs between the origin and a copy to keep.
+type conflicts struct {
+	roots       []string
+	files       []plan.ConflictingFile
+	resolutions map[string]plan.Resolution
+	// rules are the rules made here, the latest first, which go before the configured ones.
+	rules      []plan.Rule
+	configured []plan.Rule
+	// policies decide the files without a resolution, as the configured rules do.
+	policies map[string]plan.Policy
+	cursor   int
+	offset   int
+	// pattern is the pattern of the rule being made, typed while typing is set;
+	// choosing waits for the choice to apply to it.
+	pattern  string
+	typing   bool
+	choosing bool
+}
+
+func newConflicts(snapshots []plan.Snapshot, p *plan.Plan, opts plan.Options) *conflicts {
+	c := &conflicts{
+		files:       plan.ConflictingFiles(snapshots),
+		resolutions: map[string]plan.Resolution{},
+		configured:  opts.Rules,
+		policies:    map[string]plan.Policy{},
+	}
+	for _, snapshot := range snapshots {
+		c.roots = append(c.roots, snapshot.Root)
+	}
+	maps.Copy(c.resolutions, opts.Resolutions)
+	for _, decision := range p.Decisions {
+		if _, ok := opts.Resolutions[decision.Path]; !ok {
+			c.policies[decision.Path] = decision.Policy
+		}
+	}
+	if opts.Bidirectional {
+		// Files changed in a single archive are no conflicts, and a file deleted in one archive
+		// and changed in another is one.
+		c.files = plan.DecidedFiles(snapshots, p.Decisions)
+	}
+	return c
+}
+
+// update handles a key; it returns whether the user is done resolving.
+func (c *conflicts) update(msg tea.KeyMsg, height int) bool {
+	defer c.scroll(height)
+	if c.typing {
+		switch msg.Type {
+		case tea.KeyEnter:
+			c.typing = false
+			c.choosing = c.pattern != ""
+		case tea.KeyEsc:
+			c.typing = false
+		case tea.KeyBackspace:
+			if c.pattern != "" {
+				runes := []rune(c.pattern)
+				c.pattern = string(runes[:len(runes)-1])
+			}
+		case tea.KeyRunes, tea.KeySpace:
+			c.pattern += string(msg.Runes)
+		}
+		return false
+	}
+	if c.choosing {
+		c.choosing = false
+		if policy, ok := policyKeys[strings.ToLower(msg.String())]; ok {
+			c.addRule(plan.Rule{Pattern: c.pattern, Policy: policy})
+		}
+		return false
+	}
+
+	page := c.lines(height)
+	key := msg.String()
+	switch key {
+	case "up", "k":
+		c.cursor = max(c.cursor-1, 0)
+	case "down", "j":
+		c.cursor = min(c.cursor+1, len(c.files)-1)
+	case "pgup":
+		c.cursor = max(c.cursor-page, 0)
+	case "pgdown":
+		c.cursor = min(c.cursor+page, len(c.files)-1)
+	case "o", "n", "l", "b", "s":
+		c.resolve(c.files[c.cursor], key)
+	case "O", "N", "L", "B", "S":
+		for _, file := range c.files {
+			c.resolve(file, strings.ToLower(key))
+		}
+	case "1", "2", "3", "4", "5", "6", "7", "8", "9":
+		archive := int(key[0] - '0')
+		if archive < len(c.roots) && c.files[c.cursor].Versions[archive] != nil {
+			c.resolutions[c.files[c.cursor].Path] = plan.Resolution{Policy: plan.CopyWins, Archive: archive}
+		}
+	case "p":
+		c.pattern = suggestedPattern(c.files[c.cursor].Path)
+		c.typing = true
+	case "c", "esc", "q", "enter":
+		return true
+	}
+	return false
+}
+
+// suggestedPattern returns a pattern for the folder of the file, or for its extension at the top.
+func suggestedPattern(file string) string {
+	if dir := path.Dir(file); dir != "." {
+		return dir + "/"
+	}
+	if ext := path.Ext(file); ext != "" {
+		return "*" + ext
+	}
+	return file
+}
+
+// addRule puts the rule before the others and drops the choices made for the files it matches,
+// so that the latest choice decides.
+func (c *conflicts) addRule(rule plan.Rule) {
+	c.rules = slices.Insert(c.rules, 0, rule)
+	for _, file := range c.files {
+		if rule.Matches(file.Path) {
+			delete(c.resolutions, file.Path)
+		}
+	}
+}
+
+// allRules returns the rules made here followed by the configured ones.
+func (c *conflicts) allRules() []plan.Rule {
+	return slices.Concat(c.rules, c.configured)
+}
+
+var policyKeys = map[string]plan.Policy{
+	"o": plan.OriginWins,
+	"n": plan.NewestWins,
+	"l": plan.LargestWins,
+	"b": plan.KeepBoth,
+	"s": plan.Skip,
+}
+
+func (c *conflicts) resolve(file plan.ConflictingFile, key string) {
+	c.resolutions[file.Path] = plan.Resolution{Policy: policyKeys[key]}
+}
+
+// decision describes the resolution of a file in words.
+func (c *conflicts) decision(file plan.ConflictingFile) string {
+	resolution, ok := c.resolutions[file.Path]
+	if !ok {
+		resolution.Policy = c.policies[file.Path]
+		if i := slices.IndexFunc(c.rules, func(rule plan.Rule) bool { return rule.Matches(file.Path) }); i >= 0 {
+			resolution.Policy = c.rules[i].Policy
+		}
+	}
+	switch resolution.Policy {
+	case plan.NewestWins:
+		return "keep the newest"
+	case plan.LargestWins:
+		return "keep the largest"
+	case plan.KeepBoth:
+		return "keep both"
+	case plan.Skip:
+		return "skip"
+	case plan.CopyWins:
+		return "keep " + c.roots[resolution.Archive]
+	}
+	return "keep the origin"
+}
+
+// lines is the number of files the list shows.
+func (c *conflicts) lines(height int) int {
+	return max(height-len(c.roots)-4, 1)
+}
+
+// scroll keeps the cursor on the screen.
+func (c *conflicts) scroll(height int) {
+	c.offset = scroll(c.offset, c.cursor, c.lines(height))
+}
+
+func (c *conflicts) view(width, height int) string {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "%s\n", headerStyle.Render(fit(fmt.Sprintf("%d files differ between the origin and a copy", len(c.files)), width)))
+
+	for i := c.offset; i < c.offset+c.lines(height); i++ {
+		if i < len(c.files) {
+			file := c.files[i]
+			line := fit(fmt.Sprintf("  %-20s %s", c.decision(file), file.Path), width)
+			if i == c.cursor {
+				line = cursorStyle.Render(line)
+			}
+			b.WriteString(line)
+		}
+		b.WriteString("\n")
+	}
+
+	b.WriteString(strings.Repeat("─", max(width, 1)) + "\n")
+	file := c.files[c.cursor]
+	newest := -1
+	for i, v := range file.Versions {
+		if v != nil && (newest < 0 || v.ModTime.After(file.Versions[newest].ModTime)) {
+			newest = i
+		}
+	}
+	fmt.Fprintf(&b, "%s\n", fit(file.Path, width))
+	for i, v := range file.Versions {
+		label := fmt.Sprintf("%d %s", i, c.roots[i])
+		if i == 0 {
+			label = "  " + c.roots[i]
+		}
+		if v == nil {
+			fmt.Fprintf(&b, "%s\n", fit(fmt.Sprintf("  %-30s absent", label), width))
+			continue
+		}
+		note := ""
+		if i == newest {
+			note = "  newest"
+		}
+		fmt.Fprintf(&b, "%s\n", fit(fmt.Sprintf("  %-30s %10s  %s  %s%s",
+			label, fs.FormatSize(v.Size), v.ModTime.Local().Format("2006-01-02 15:04:05"), v.Hash, note), width))
+	}
+	switch {
+	case c.typing:
+		fmt.Fprintf(&b, "pattern: %s▏  enter: pick the choice  esc: cancel", c.pattern)
+	case c.choosing:
+		b.WriteString(fit(fmt.Sprintf("o/n/l/b/s: the choice for %s  any other key: cancel", c.pattern), width))
+	default:
+		b.WriteString(fit("o/n/l/b: keep the origin/newest/largest/both  s: skip  1-9: keep that copy  O/N/L/B/S: for all files  p: for a pattern  c: back", width))
+	}
+	return b.String()
+}
@@ -0,0 +1,452 @@
+package app
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+
+	"dup/fs"
+	"dup/guard"
+	"dup/plan"
+)
+
+// reviewMsg asks the user to confirm the plan before the engine executes it.
+// The confirmed plan, or nil if the user aborted, goes to decision.
+type reviewMsg struct {
+	plan      *plan.Plan
+	opts      plan.Options
+	snapshots []plan.Snapshot
+	limits    guard.Limits
+	trips     []guard.Trip
+	decision  chan<- *plan.Plan
+}
+
+type entry struct {
+	plan.Entry
+	archive int
+	action  string
+	to      string
+	size    int
+	// excluded is set by the user, dropped when the entry depends on an excluded one.
+	excluded bool
+	dropped  bool
+}
+
+// Row levels
+const (
+	archiveRow = iota
+	dirRow
+	entryRow
+)
+
+type row struct {
+	level   int
+	archive int
+	dir     string
+	entry   *entry
+}
+
+type review struct {
+	plan      *plan.Plan
+	opts      plan.Options
+	snapshots []plan.Snapshot
+	decision  chan<- *plan.Plan
+	// trips are the limits the plan exceeds; forcing asks the user to start the sync anyway.
+	limits    guard.Limits
+	trips     []guard.Trip
+	forcing   bool
+	tree      *tree
+	conflicts *conflicts
+	browsing  bool
+	resolving bool
+	entries   []*entry
+	rows      []row
+	cursor    int
+	offset    int
+	search    string
+	searching bool
+}
+
+var (
+	cursorStyle   = lipgloss.NewStyle().Reverse(true)
+	headerStyle   = lipgloss.NewStyle().Bold(true)
+	excludedStyle = lipgloss.NewStyle().Faint(true)
+	warningStyle  = lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("1"))
+)
+
+func newReview(msg reviewMsg) *review {
+	r := &review{opts: msg.opts, snapshots: msg.snapshots, decision: msg.decision, limits: msg.limits, trips: msg.trips}
+	r.setPlan(msg.plan)
+	return r
+}
+
+// setPlan lists the entries of the plan; entries excluded from the previous plan stay excluded.
+func (r *review) setPlan(p *plan.Plan) {
+	excluded := map[plan.Entry]bool{}
+	for _, e := range r.entries {
+		if e.excluded {
+			excluded[e.Entry] = true
+		}
+	}
+
+	r.plan = p
+	r.entries = nil
+	for i, archive := range p.Archives {
+		for _, rename := range archive.Renames {
+			r.entries = append(r.entries, &entry{
+				Entry:   plan.Entry{Root: archive.Root, Path: rename.SourcePath},
+				archive: i,
+				action:  rename.Action.String(),
+				to:      rename.DestinationPath,
+				size:    rename.Size,
+			})
+		}
+	}
+	for _, archive := range p.Archives {
+		for _, copy := range archive.Copies {
+			for _, root := range copy.ToRoots {
+				r.entries = append(r.entries, &entry{
+					Entry:   plan.Entry{Root: root, Path: copy.Path, Copy: true},
+					archive: slices.IndexFunc(p.Archives, func(a plan.Archive) bool { return a.Root == root }),
+					action:  "copy",
+					size:    copy.Size,
+				})
+			}
+		}
+	}
+	for _, e := range r.entries {
+		e.excluded = excluded[e.Entry]
+	}
+	slices.SortStableFunc(r.entries, func(a, b *entry) int {
+		if a.archive != b.archive {
+			return a.archive - b.archive
+		}
+		if c := strings.Compare(dirKey(a.Path), dirKey(b.Path)); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Path, b.Path)
+	})
+	r.drop()
+	r.layout()
+}
+
+// dirKey sorts a folder before its subfolders and its subfolders before its siblings.
+func dirKey(path string) string {
+	return strings.ReplaceAll(filepath.Dir(path), "/", "\x00")
+}
+
+func (r *review) layout() {
+	r.rows = r.rows[:0]
+	query := strings.ToLower(r.search)
+	archive, dir := -1, ""
+	for _, e := range r.entries {
+		if query != "" && !strings.Contains(strings.ToLower(e.Path+" "+e.to), query) {
+			continue
+		}
+		if e.archive != archive {
+			archive, dir = e.archive, ""
+			r.rows = append(r.rows, row{level: archiveRow, archive: archive})
+		}
+		if d := filepath.Dir(e.Path); d != dir {
+			dir = d
+			r.rows = append(r.rows, row{level: dirRow, archive: archive, dir: dir})
+		}
+		r.rows = append(r.rows, row{level: entryRow, archive: archive, dir: dir, entry: e})
+	}
+	r.cursor = min(r.cursor, max(len(r.rows)-1, 0))
+}
+
+// group returns the entries of the row; the entries of all rows below it for archives and folders.
+func (r *review) group(idx int) []*entry {
+	header := r.rows[idx]
+	if header.level == entryRow {
+		return []*entry{header.entry}
+	}
+	var result []*entry
+	for _, row := range r.rows[idx+1:] {
+		if row.level == archiveRow || row.level == dirRow && header.level == dirRow && !fs.InDir(row.dir, header.dir) {
+			break
+		}
+		if row.level == entryRow {
+			result = append(result, row.entry)
+		}
+	}
+	return result
+}
+
+func (r *review) toggle() {
+	if len(r.rows) == 0 {
+		return
+	}
+	entries := r.group(r.cursor)
+	exclude := slices.ContainsFunc(entries, func(e *entry) bool { return !e.excluded })
+	for _, e := range entries {
+		e.excluded = exclude
+	}
+	r.drop()
+}
+
+// drop marks the entries which depend on excluded ones.
+func (r *review) drop() {
+	kept := map[plan.Entry]bool{}
+	result := r.result()
+	for _, archive := range result.Archives {
+		for _, rename := range archive.Renames {
+			kept[plan.Entry{Root: archive.Root, Path: rename.SourcePath}] = true
+		}
+	}
+	for _, archive := range result.Archives {
+		for _, copy := range archive.Copies {
+			for _, root := range copy.ToRoots {
+				kept[plan.Entry{Root: root, Path: copy.Path, Copy: true}] = true
+			}
+		}
+	}
+	for _, e := range r.entries {
+		e.dropped = !e.excluded && !kept[e.Entry]
+	}
+}
+
+func (r *review) result() *plan.Plan {
+	excluded := map[plan.Entry]bool{}
+	for _, e := range r.entries {
+		if e.excluded {
+			excluded[e.Entry] = true
+		}
+	}
+	return r.plan.Without(excluded)
+}
+
+// update handles a key; it returns the command to run and whether the review is over.
+func (r *review) update(msg tea.KeyMsg, height int) (tea.Cmd, bool) {
+	defer r.scroll(height)
+	if r.browsing {
+		r.browsing = !r.tree.update(msg, height)
+		return nil, false
+	}
+	if r.resolving {
+		if r.conflicts.update(msg, height) {
+			r.resolving = false
+			r.opts.Resolutions = r.conflicts.resolutions
+			r.opts.Rules = r.conflicts.allRules()
+			r.setPlan(plan.Make(r.snapshots, r.opts))
+		}
+		return nil, false
+	}
+	if r.searching {
+		switch msg.Type {
+		case tea.KeyEnter:
+			r.searching = false
+		case tea.KeyEsc:
+			r.searching = false
+			r.search = ""
+		case tea.KeyBackspace:
+			if r.search != "" {
+				runes := []rune(r.search)
+				r.search = string(runes[:len(runes)-1])
+			}
+		case tea.KeyRunes, tea.KeySpace:
+			r.search += string(msg.Runes)
+		}
+		r.layout()
+		return nil, false
+	}
+
+	if r.forcing {
+		r.forcing = false
+		if msg.String() == "F" {
+			return r.start(r.result()), true
+		}
+		return nil, false
+	}
+
+	page := r.lines(height)
+	switch msg.String() {
+	case "up", "k":
+		r.cursor = max(r.cursor-1, 0)
+	case "down", "j":
+		r.cursor = min(r.cursor+1, max(len(r.rows)-1, 0))
+	case "pgup":
+		r.cursor = max(r.cursor-page, 0)
+	case "pgdown":
+		r.cursor = min(r.cursor+page, max(len(r.rows)-1, 0))
+	case "home", "g":
+		r.cursor = 0
+	case "end", "G":
+		r.cursor = max(len(r.rows)-1, 0)
+	case " ", "x":
+		r.toggle()
+	case "/":
+		r.searching = true
+	case "t":
+		if r.tree == nil {
+			r.tree = newTree(r.snapshots)
+		}
+		r.browsing = true
+	case "c":
+		if r.conflicts == nil {
+			r.conflicts = newConflicts(r.snapshots, r.plan, r.opts)
+		}
+		r.resolving = len(r.conflicts.files) > 0
+	case "enter", "y":
+		p := r.result()
+		if r.trips = guard.Check(p, r.limits); len(r.trips) > 0 {
+			r.forcing = true
+			return nil, false
+		}
+		return r.start(p), true
+	case "esc", "q":
+		if r.search != "" {
+			r.search = ""
+			r.layout()
+			return nil, false
+		}
+		decision := r.decision
+		return tea.Sequence(func() tea.Msg {
+			decision <- nil
+			return nil
+		}, tea.Quit), true
+	}
+	return nil, false
+}
+
+// start returns the command that hands the plan to the engine.
+func (r *review) start(p *plan.Plan) tea.Cmd {
+	decision := r.decision
+	return func() tea.Msg {
+		decision <- p
+		return nil
+	}
+}
+
+type totals struct {
+	counts map[string]int
+	size   int
+}
+
+func (r *review) totals(archive int) totals {
+	t := totals{counts: map[string]int{}}
+	for _, e := range r.entries {
+		if (archive < 0 || e.archive == archive) && !e.excluded && !e.dropped {
+			t.counts[e.action]++
+			if e.action == "copy" {
+				t.size += e.size
+			}
+		}
+	}
+	return t
+}
+
+func (t totals) String() string {
+	return fmt.Sprintf("%d moves, %d backups, %d conflicts, %d copies (%s)",
+		t.counts["move"], t.counts["backup"], t.counts["conflict"], t.counts["copy"], fs.FormatSize(t.size))
+}
+
+// lines is the number of rows the review shows.
+func (r *review) lines(height int) int {
+	return max(height-3-len(r.trips), 1)
+}
+
+// scroll keeps the cursor of the review, the tree and the conflicts on the screen.
+func (r *review) scroll(height int) {
+	r.offset = scroll(r.offset, r.cursor, r.lines(height))
+	if r.tree != nil {
+		r.tree.scroll(height)
+	}
+	if r.conflicts != nil {
+		r.conflicts.scroll(height)
+	}
+}
+
+func (r *review) view(width, height int) string {
+	if r.browsing {
+		return r.tree.view(width, height)
+	}
+	if r.resolving {
+		return r.conflicts.view(width, height)
+	}
+	b := strings.Builder{}
+	excluded := 0
+	for _, e := range r.entries {
+		if e.excluded || e.dropped {
+			excluded++
+		}
+	}
+	fmt.Fprintf(&b, "%s\n", headerStyle.Render(fit(fmt.Sprintf("Review: %s; %d excluded", r.totals(-1), excluded), width)))
+	for _, trip := range r.trips {
+		fmt.Fprintf(&b, "%s\n", warningStyle.Render(fit("Too many changes: "+trip.String(), width)))
+	}
+
+	lines := r.lines(height)
+	for i := r.offset; i < min(r.offset+lines, len(r.rows)); i++ {
+		line := r.line(r.rows[i], width)
+		if i == r.cursor {
+			line = cursorStyle.Render(line)
+		}
+		b.WriteString(line + "\n")
+	}
+	for i := len(r.rows); i < r.offset+lines; i++ {
+		b.WriteString("\n")
+	}
+
+	if r.forcing {
+		b.WriteString(fit("F: start anyway  any other key: back to the review", width))
+	} else if r.searching {
+		fmt.Fprintf(&b, "search: %s▏", r.search)
+	} else if r.search != "" {
+		fmt.Fprintf(&b, "search: %s  (esc clears)", r.search)
+	} else {
+		b.WriteString(fit("enter: start  space: exclude/include  /: search  t: differences  c: conflicts  esc: abort", width))
+	}
+	return b.String()
+}
+
+func (r *review) line(row row, width int) string {
+	switch row.level {
+	case archiveRow:
+		root := r.plan.Archives[row.archive].Root
+		return headerStyle.Render(fit(fmt.Sprintf("%s: %s", root, r.totals(row.archive)), width))
+	case dirRow:
+		return fit(fmt.Sprintf("  %s/", row.dir), width)
+	}
+	e := row.entry
+	mark := "[x]"
+	if e.excluded {
+		mark = "[ ]"
+	} else if e.dropped {
+		mark = "[-]"
+	}
+	name := filepath.Base(e.Path)
+	if e.to != "" {
+		name += " -> " + e.to
+	}
+	line := fit(fmt.Sprintf("    %s %-8s %10s  %s", mark, e.action, fs.FormatSize(e.size), name), width)
+	if e.excluded || e.dropped {
+		line = excludedStyle.Render(line)
+	}
+	return line
+}
+
+// scroll returns the offset of the first line shown so that the cursor is among the lines shown.
+func scroll(offset, cursor, lines int) int {
+	if cursor < offset {
+		return cursor
+	}
+	if cursor >= offset+lines {
+		return cursor - lines + 1
+	}
+	return offset
+}
+
+// fit cuts the line to the screen width.
+func fit(line string, width int) string {
+	runes := []rune(line)
+	if width <= 1 || len(runes) <= width {
+		return line
+	}
+	return string(runes[:width-1]) + "…"
+}
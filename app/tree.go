@@ -0,0 +1,283 @@
+package app
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+
+	"dup/fs"
+	"dup/plan"
+)
+
+// status tells how a file of a copy differs from the origin.
+type status int
+
+const (
+	identical status = iota
+	missing
+	extra
+	conflicting
+	moved
+	statusCount
+	// absent files are in neither the origin nor the copy.
+	absent = statusCount
+)
+
+var statusNames = [statusCount]string{"identical", "missing", "extra", "conflicting", "moved"}
+
+type node struct {
+	name     string
+	path     string
+	depth    int
+	parent   *node
+	children []*node
+	expanded bool
+	// metas hold the file in every archive, nil where it is absent; nil for folders.
+	metas []*fs.FileMeta
+	// status of the file in every copy.
+	status []status
+	// counts and sizes of the files of a folder by copy and status.
+	counts [][statusCount]int
+	sizes  [][statusCount]int
+}
+
+func (n *node) isDir() bool {
+	return n.metas == nil
+}
+
+// tree browses the differences between the origin and each copy folder by folder.
+type tree struct {
+	roots  []string
+	root   *node
+	rows   []*node
+	cursor int
+	offset int
+	copy   int
+}
+
+func newTree(snapshots []plan.Snapshot) *tree {
+	t := &tree{copy: 1}
+	archives := len(snapshots)
+	t.root = &node{name: ".", path: ".", expanded: true}
+	dirs := map[string]*node{".": t.root}
+	files := map[string]*node{}
+	hashes := make([]map[string]bool, archives)
+
+	var dir func(path string) *node
+	dir = func(path string) *node {
+		if n, ok := dirs[path]; ok {
+			return n
+		}
+		parent := dir(filepath.Dir(path))
+		n := &node{name: filepath.Base(path), path: path, depth: parent.depth + 1, parent: parent}
+		parent.children = append(parent.children, n)
+		dirs[path] = n
+		return n
+	}
+
+	for i, snapshot := range snapshots {
+		t.roots = append(t.roots, snapshot.Root)
+		hashes[i] = map[string]bool{}
+		for j := range snapshot.Files {
+			meta := &snapshot.Files[j]
+			hashes[i][meta.Hash] = true
+			n, ok := files[meta.Path]
+			if !ok {
+				parent := dir(filepath.Dir(meta.Path))
+				n = &node{
+					name:   filepath.Base(meta.Path),
+					path:   meta.Path,
+					depth:  parent.depth + 1,
+					parent: parent,
+					metas:  make([]*fs.FileMeta, archives),
+					status: make([]status, archives),
+				}
+				parent.children = append(parent.children, n)
+				files[meta.Path] = n
+			}
+			n.metas[i] = meta
+		}
+	}
+
+	for _, n := range dirs {
+		n.counts = make([][statusCount]int, archives)
+		n.sizes = make([][statusCount]int, archives)
+		slices.SortFunc(n.children, func(a, b *node) int {
+			if a.isDir() != b.isDir() {
+				if a.isDir() {
+					return -1
+				}
+				return 1
+			}
+			return strings.Compare(a.name, b.name)
+		})
+	}
+
+	for _, n := range files {
+		origin := n.metas[0]
+		for i := 1; i < archives; i++ {
+			copy := n.metas[i]
+			size := 0
+			switch {
+			case origin != nil && copy != nil && origin.Hash == copy.Hash:
+				n.status[i], size = identical, origin.Size
+			case origin != nil && copy != nil:
+				n.status[i], size = conflicting, origin.Size
+			case origin != nil && hashes[i][origin.Hash]:
+				n.status[i], size = moved, origin.Size
+			case origin != nil:
+				n.status[i], size = missing, origin.Size
+			case copy != nil && hashes[0][copy.Hash]:
+				// The other end of a move; it is counted where the file is in the origin.
+				n.status[i] = moved
+				continue
+			case copy != nil:
+				n.status[i], size = extra, copy.Size
+			default:
+				n.status[i] = absent
+				continue
+			}
+			for dir := n.parent; dir != nil; dir = dir.parent {
+				dir.counts[i][n.status[i]]++
+				dir.sizes[i][n.status[i]] += size
+			}
+		}
+	}
+	t.layout()
+	return t
+}
+
+func (t *tree) layout() {
+	t.rows = t.rows[:0]
+	var add func(n *node)
+	add = func(n *node) {
+		t.rows = append(t.rows, n)
+		if n.expanded {
+			for _, child := range n.children {
+				add(child)
+			}
+		}
+	}
+	add(t.root)
+	t.cursor = min(t.cursor, len(t.rows)-1)
+}
+
+// update handles a key; it returns whether the user left the tree.
+func (t *tree) update(msg tea.KeyMsg, height int) bool {
+	defer t.scroll(height)
+	page := t.lines(height)
+	n := t.rows[t.cursor]
+	switch msg.String() {
+	case "up", "k":
+		t.cursor = max(t.cursor-1, 0)
+	case "down", "j":
+		t.cursor = min(t.cursor+1, len(t.rows)-1)
+	case "pgup":
+		t.cursor = max(t.cursor-page, 0)
+	case "pgdown":
+		t.cursor = min(t.cursor+page, len(t.rows)-1)
+	case "home", "g":
+		t.cursor = 0
+	case "end", "G":
+		t.cursor = len(t.rows) - 1
+	case "right", "l", "enter", " ":
+		if n.isDir() {
+			n.expanded = !n.expanded || msg.String() == "right" || msg.String() == "l"
+			t.layout()
+		}
+	case "left", "h":
+		if n.isDir() && n.expanded {
+			n.expanded = false
+		} else if n.parent != nil {
+			n.parent.expanded = false
+			t.cursor = slices.Index(t.rows, n.parent)
+		}
+		t.layout()
+	case "tab":
+		t.copy = t.copy%(len(t.roots)-1) + 1
+	case "t", "esc", "q":
+		return true
+	}
+	return false
+}
+
+// lines is the number of rows the tree shows.
+func (t *tree) lines(height int) int {
+	return max(height-len(t.roots)-4, 1)
+}
+
+// scroll keeps the cursor on the screen.
+func (t *tree) scroll(height int) {
+	t.offset = scroll(t.offset, t.cursor, t.lines(height))
+}
+
+func (t *tree) view(width, height int) string {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "%s\n", headerStyle.Render(fit(fmt.Sprintf("Differences between %s and %s", t.roots[0], t.roots[t.copy]), width)))
+
+	for i := t.offset; i < t.offset+t.lines(height); i++ {
+		if i < len(t.rows) {
+			line := t.line(t.rows[i], width)
+			if i == t.cursor {
+				line = cursorStyle.Render(line)
+			}
+			b.WriteString(line)
+		}
+		b.WriteString("\n")
+	}
+
+	b.WriteString(strings.Repeat("─", max(width, 1)) + "\n")
+	b.WriteString(t.details(t.rows[t.cursor], width))
+	b.WriteString(fit("tab: next copy  →/←: expand/collapse  t: back to the plan", width))
+	return b.String()
+}
+
+func (t *tree) line(n *node, width int) string {
+	indent := strings.Repeat("  ", n.depth)
+	if !n.isDir() {
+		name := ""
+		if s := n.status[t.copy]; s != absent {
+			name = statusNames[s]
+		}
+		return fit(fmt.Sprintf("%s  %-30s %s", indent, n.name, name), width)
+	}
+	marker := "▸"
+	if n.expanded {
+		marker = "▾"
+	}
+	return fit(fmt.Sprintf("%s%s %-30s %s", indent, marker, n.name+"/", t.summary(n, t.copy)), width)
+}
+
+func (t *tree) summary(n *node, copy int) string {
+	parts := []string{}
+	for _, s := range []status{missing, extra, conflicting, moved, identical} {
+		if count := n.counts[copy][s]; count > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s (%s)", count, statusNames[s], fs.FormatSize(n.sizes[copy][s])))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// details describe the file in every archive, or the folder in every copy.
+func (t *tree) details(n *node, width int) string {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "%s\n", fit(n.path, width))
+	for i, root := range t.roots {
+		switch {
+		case n.isDir() && i == 0:
+			fmt.Fprintf(&b, "%s\n", fit(fmt.Sprintf("  %s: origin", root), width))
+		case n.isDir():
+			fmt.Fprintf(&b, "%s\n", fit(fmt.Sprintf("  %s: %s", root, t.summary(n, i)), width))
+		case n.metas[i] == nil:
+			fmt.Fprintf(&b, "%s\n", fit(fmt.Sprintf("  %-30s absent", root), width))
+		default:
+			meta := n.metas[i]
+			fmt.Fprintf(&b, "%s\n", fit(fmt.Sprintf("  %-30s %10s  %s  %s",
+				root, fs.FormatSize(meta.Size), meta.ModTime.Local().Format("2006-01-02 15:04:05"), meta.Hash), width))
+		}
+	}
+	return b.String()
+}
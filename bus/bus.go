@@ -0,0 +1,223 @@
+package bus
+
+import (
+	"sync"
+	"time"
+)
+
+type Sink interface {
+	Handle(event any)
+}
+
+type SinkFunc func(event any)
+
+func (f SinkFunc) Handle(event any) {
+	f(event)
+}
+
+// Mergeable events report high-frequency progress. An undelivered mergeable event absorbs
+// later events with the same key, and merged events are delivered at the bus refresh rate.
+type Mergeable interface {
+	MergeKey() any
+	Merge(later any) (any, bool)
+}
+
+// Transient events only report progress, like a file being hashed. A sink that falls highWater
+// events behind misses them until it catches up, and then receives a Dropped event counting them.
+type Transient interface {
+	Transient()
+}
+
+// Dropped tells a sink how many transient events it missed.
+type Dropped struct {
+	Events int
+}
+
+// highWater is the number of queued events past which transient events are dropped.
+const highWater = 4096
+
+// Bus fans events out to sinks. Every sink is served by its own goroutine from a queue
+// bounded by dropping transient events, so Send never blocks no matter how slow a sink is.
+type Bus struct {
+	refreshRate time.Duration
+	mu          sync.Mutex
+	subscribers []*subscriber
+	closed      bool
+	wg          sync.WaitGroup
+}
+
+type subscriber struct {
+	sink    Sink
+	mu      sync.Mutex
+	queue   []any
+	pending []Mergeable
+	signal  chan struct{}
+	closed  bool
+	// lossless subscribers receive every event however far behind they fall.
+	lossless bool
+	dropped  int
+}
+
+func New(refreshRate time.Duration) *Bus {
+	return &Bus{refreshRate: refreshRate}
+}
+
+func (b *Bus) Subscribe(sink Sink) {
+	b.subscribe(&subscriber{sink: sink, signal: make(chan struct{}, 1)})
+}
+
+// SubscribeAll subscribes a sink that never misses transient events, for sinks that keep up.
+func (b *Bus) SubscribeAll(sink Sink) {
+	b.subscribe(&subscriber{sink: sink, signal: make(chan struct{}, 1), lossless: true})
+}
+
+func (b *Bus) subscribe(s *subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.subscribers = append(b.subscribers, s)
+	b.wg.Add(1)
+	go b.serve(s)
+}
+
+func (b *Bus) Send(event any) {
+	b.mu.Lock()
+	subscribers := b.subscribers
+	b.mu.Unlock()
+
+	for _, s := range subscribers {
+		s.add(event)
+	}
+}
+
+// Close delivers everything still queued and waits for the sinks to finish.
+// Events sent after Close are dropped.
+func (b *Bus) Close() {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.closed = true
+	subscribers := b.subscribers
+	b.subscribers = nil
+	b.mu.Unlock()
+
+	for _, s := range subscribers {
+		s.close()
+	}
+	b.wg.Wait()
+}
+
+func (b *Bus) serve(s *subscriber) {
+	defer b.wg.Done()
+	ticker := time.NewTicker(b.refreshRate)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.signal:
+		case <-ticker.C:
+			s.flush()
+		}
+		events, closed := s.take()
+		for _, event := range events {
+			s.sink.Handle(event)
+		}
+		if closed {
+			return
+		}
+	}
+}
+
+func (s *subscriber) add(event any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+
+	if event, ok := event.(Mergeable); ok {
+		for i, pending := range s.pending {
+			if pending.MergeKey() != event.MergeKey() {
+				continue
+			}
+			if merged, ok := pending.Merge(event); ok {
+				s.pending[i] = merged.(Mergeable)
+				return
+			}
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			s.enqueue(pending)
+			break
+		}
+		s.pending = append(s.pending, event)
+		return
+	}
+
+	if s.dropping(event) {
+		return
+	}
+	// Pending progress goes first so that sinks see it before whatever follows it.
+	s.flushLocked()
+	s.enqueue(event)
+}
+
+// enqueue queues the event unless it is dropped.
+func (s *subscriber) enqueue(event any) {
+	if s.dropping(event) {
+		return
+	}
+	s.queue = append(s.queue, event)
+	s.notify()
+}
+
+// dropping tells whether the event is dropped, counting it if so.
+func (s *subscriber) dropping(event any) bool {
+	if _, ok := event.(Transient); !ok || s.lossless || len(s.queue) < highWater {
+		return false
+	}
+	s.dropped++
+	return true
+}
+
+func (s *subscriber) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flushLocked()
+}
+
+func (s *subscriber) flushLocked() {
+	if s.dropped > 0 {
+		s.queue = append(s.queue, Dropped{Events: s.dropped})
+		s.dropped = 0
+	}
+	for _, pending := range s.pending {
+		s.queue = append(s.queue, pending)
+	}
+	s.pending = s.pending[:0]
+}
+
+func (s *subscriber) take() ([]any, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := s.queue
+	s.queue = nil
+	return events, s.closed
+}
+
+func (s *subscriber) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flushLocked()
+	s.closed = true
+	s.notify()
+}
+
+func (s *subscriber) notify() {
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,99 @@
+package bus
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type transient int
+
+func (transient) Transient() {}
+
+// progress counts done work; progress with the same key merges into the later one.
+type progress struct {
+	key  string
+	done int
+}
+
+func (p progress) MergeKey() any {
+	return p.key
+}
+
+func (p progress) Merge(later any) (any, bool) {
+	next, ok := later.(progress)
+	return next, ok
+}
+
+// TestEventsAreDeliveredInOrderAndProgressCoalesced checks that a slow sink gets every event
+// in the order sent, with the progress sent in between merged and delivered before what follows it.
+func TestEventsAreDeliveredInOrderAndProgressCoalesced(t *testing.T) {
+	b := New(time.Hour)
+	release := make(chan struct{})
+	var got []any
+	b.Subscribe(SinkFunc(func(event any) {
+		<-release
+		got = append(got, event)
+	}))
+
+	b.Send("start")
+	for i := range 100 {
+		b.Send(progress{"a", i})
+		b.Send(progress{"b", i})
+	}
+	b.Send("middle")
+	b.Send(progress{"a", 100})
+	b.Send("end")
+	close(release)
+	b.Close()
+
+	want := []any{"start", progress{"a", 99}, progress{"b", 99}, "middle", progress{"a", 100}, "end"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// TestSlowSinkDropsTransientEvents checks that a sink that falls behind misses transient events
+// beyond the high-water mark, is told how many, and still gets every other event in order.
+func TestSlowSinkDropsTransientEvents(t *testing.T) {
+	b := New(time.Hour)
+	handling, release := make(chan struct{}), make(chan struct{})
+	var got, all []any
+	b.Subscribe(SinkFunc(func(event any) {
+		if event == "first" {
+			close(handling)
+		}
+		<-release
+		got = append(got, event)
+	}))
+	b.SubscribeAll(SinkFunc(func(event any) { all = append(all, event) }))
+
+	b.Send("first")
+	// The queue is empty while the sink handles the first event.
+	<-handling
+	for i := range 2 * highWater {
+		b.Send(transient(i))
+	}
+	b.Send("last")
+	close(release)
+	b.Close()
+
+	if len(all) != 2*highWater+2 {
+		t.Errorf("the lossless sink got %d events, want %d", len(all), 2*highWater+2)
+	}
+	transients, dropped := 0, 0
+	for _, event := range got {
+		switch event := event.(type) {
+		case transient:
+			transients++
+		case Dropped:
+			dropped += event.Events
+		}
+	}
+	if transients+dropped != 2*highWater || transients > highWater+1 {
+		t.Errorf("got %d transient events and %d dropped, want at most %d and %d in all", transients, dropped, highWater+1, 2*highWater)
+	}
+	if got[0] != "first" || got[len(got)-1] != "last" {
+		t.Errorf("got %v first and %v last, want first and last", got[0], got[len(got)-1])
+	}
+}
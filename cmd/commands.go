@@ -0,0 +1,787 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"flag"
+	"fmt"
+	iofs "io/fs"
+	"maps"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"dup/app"
+	"dup/bus"
+	"dup/dryrun"
+	"dup/engine"
+	"dup/fs"
+	"dup/fs/mockfs"
+	"dup/fs/realfs"
+	"dup/guard"
+	"dup/headless"
+	"dup/jsonl"
+	"dup/lifecycle"
+	"dup/plan"
+)
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{
+			name:     "sync",
+			args:     "origin copy...",
+			summary:  "make every copy identical to the origin",
+			archives: true,
+			flags: func(flags *flag.FlagSet) {
+				flags.Bool("headless", false, "print progress lines instead of the full-screen interface;\nthe default when standard output is not a terminal")
+				flags.Bool("quiet", false, "print no progress lines, only failures and the summary; implies -headless")
+				flags.String("events", "", "write events to standard output in the given format; \"jsonl\" is the only one;\nimplies -headless and moves the summary to standard error")
+				flags.Bool("dry-run", false, "scan and report what sync would do, check free space and permissions\non the copies, and change nothing, not even the hash caches")
+				flags.Bool("additive", false, "only add files to the copies: rename, set aside and replace nothing")
+				flags.Bool("bidirectional", false, "spread changes made to any archive since the last bidirectional sync\nto the others; the conflict policy decides files changed in several")
+				flags.Bool("pull-new", false, "copy files that are new in a copy into the origin instead of leaving them in the copy")
+				flags.Bool("force", false, "sync even if a copy would change more than the limits allow")
+				flags.String("order", "", "copy the files by \"path\", \"smallest-first\" or \"disk\" order, the order they are\nstored in on disk (default \"path\")")
+				flags.Var(&listFlag{}, "priority", "copy the files matching `pattern` before the others; repeatable, the first goes first")
+			},
+			run: runSync,
+		},
+		{
+			name:     "scan",
+			args:     "archive...",
+			summary:  "hash new and changed files and update the hash caches",
+			archives: true,
+			run:      runScan,
+		},
+		{
+			name:     "plan",
+			args:     "origin copy...",
+			summary:  "show what sync would do without changing anything",
+			archives: true,
+			flags: func(flags *flag.FlagSet) {
+				flags.String("out", "", "also write the plan to `file` for review and \"dup apply\"")
+				flags.Bool("additive", false, "plan an additive sync, see \"dup help sync\"")
+				flags.Bool("bidirectional", false, "plan a bidirectional sync, see \"dup help sync\"")
+				flags.Bool("pull-new", false, "plan to copy files that are new in a copy into the origin")
+				flags.String("order", "", "plan the copies in the given order, see \"dup help sync\"")
+				flags.Var(&listFlag{}, "priority", "plan to copy the files matching `pattern` first; repeatable")
+			},
+			run: runPlan,
+		},
+		{
+			name:    "apply",
+			args:    "plan.json",
+			summary: "execute a plan written by \"dup plan -out\" after checking that it still holds",
+			flags: func(flags *flag.FlagSet) {
+				flags.Bool("skip-stale", false, "execute the entries that still hold instead of refusing the whole plan")
+				flags.Bool("force", false, "apply the plan even if a copy would change more than the limits allow")
+				flags.Bool("quiet", false, "print no progress lines, only failures and the summary")
+				flags.String("events", "", "write events to standard output in the given format; \"jsonl\" is the only one;\nmoves the summary to standard error")
+			},
+			run: runApply,
+		},
+		{
+			name:     "restore",
+			args:     "origin copy...",
+			summary:  "copy files missing from the origin back from the copies",
+			archives: true,
+			flags: func(flags *flag.FlagSet) {
+				flags.Var(&listFlag{}, "path", "restore only the file or folder at `path` in the archive; repeatable")
+				flags.Bool("dry-run", false, "list the files to restore and change nothing")
+				flags.Bool("quiet", false, "print no progress lines, only failures and the summary")
+				flags.String("events", "", "write events to standard output in the given format; \"jsonl\" is the only one;\nmoves the summary to standard error")
+			},
+			run: runRestore,
+		},
+		{
+			name:     "status",
+			args:     "origin copy...",
+			summary:  "report whether the copies are identical to the origin",
+			archives: true,
+			run:      runStatus,
+		},
+		{
+			name:     "verify",
+			args:     "origin copy...",
+			summary:  "re-read every file and check that the copies are identical to the origin",
+			archives: true,
+			run:      runVerify,
+		},
+		{
+			name:     "scrub",
+			args:     "archive...",
+			summary:  "re-read every file and report files that no longer match their cached hashes",
+			archives: true,
+			run:      runScrub,
+		},
+		{
+			name:     "dedup",
+			args:     "archive...",
+			summary:  "list files with identical content within each archive",
+			archives: true,
+			run:      runDedup,
+		},
+		{
+			name:     "init",
+			args:     "archive...",
+			summary:  "create archive folders and build their hash caches",
+			archives: true,
+			run:      runInit,
+		},
+		{
+			name:    "profiles",
+			summary: "list the archive profiles of the configuration file",
+			run:     runProfiles,
+		},
+		{
+			name:    "help",
+			args:    "[command]",
+			summary: "show help for dup or for a command",
+			run:     runHelp,
+		},
+	}
+}
+
+func runSync(cfg *config, args []string) int {
+	events := cfg.value("events")
+	if events != "" && events != "jsonl" {
+		return usageError(fmt.Sprintf("unknown event format %q", events))
+	}
+	if cfg.flag("dry-run") {
+		return runDryRun(cfg, args, events)
+	}
+	fss, lc, code := openArchives(cfg, args, 2, true, realfs.Options{})
+	if fss == nil {
+		return code
+	}
+	if !cfg.flag("headless") && !cfg.flag("quiet") && events == "" && isTerminal(os.Stdout) {
+		p, ok := app.Run(fss, lc, cfg.planOptions(fss), cfg.limits())
+		code := storeState(cfg, fss, p, ok)
+		if !ok {
+			// The sync was declined, interrupted or failed for some files.
+			fmt.Fprintf(os.Stderr, "dup: the sync did not complete\n")
+			return exitFailed
+		}
+		return code
+	}
+
+	refused := false
+	code = runHeadless(cfg, fss, lc, headless.Options{Plan: func(e *engine.Engine) *plan.Plan {
+		p := e.Plan(cfg.planOptions(fss))
+		if !checkLimits(cfg, p) {
+			refused = true
+			return nil
+		}
+		return p
+	}})
+	if refused {
+		return exitFailed
+	}
+	return code
+}
+
+// checkLimits prints the limits the plan exceeds and tells whether it may run.
+func checkLimits(cfg *config, p *plan.Plan) bool {
+	trips := guard.Check(p, cfg.limits())
+	for _, trip := range trips {
+		fmt.Fprintf(os.Stderr, "tripped   %s\n", trip)
+	}
+	if len(trips) > 0 {
+		fmt.Fprintf(os.Stderr, "dup: refusing to change that much; check the order of the archives and the origin, or use -force\n")
+		return false
+	}
+	return true
+}
+
+// additive tells whether the flags or the profile ask for an additive sync.
+func (cfg *config) additive() bool {
+	return cfg.flag("additive") || cfg.profile != nil && cfg.profile.Additive
+}
+
+// bidirectional tells whether the flags or the profile ask for a bidirectional sync.
+func (cfg *config) bidirectional() bool {
+	return cfg.flag("bidirectional") || cfg.profile != nil && cfg.profile.Bidirectional
+}
+
+// planOptions returns the options to plan a sync of the archives with, including the conflict
+// policies of the profile and the base of a bidirectional sync.
+func (cfg *config) planOptions(fss []fs.FS) plan.Options {
+	opts := plan.Options{
+		Backup:        engine.BackupName(time.Now()),
+		Additive:      cfg.additive(),
+		Bidirectional: cfg.bidirectional(),
+		PullNew:       cfg.flag("pull-new") || cfg.profile != nil && cfg.profile.PullNew,
+	}
+	if cfg.profile != nil {
+		// runProfile has checked the policies and the order.
+		opts.Policy, opts.Rules, _ = policies(cfg.profile)
+		opts.Order, _ = plan.ParseOrder(cmp.Or(cfg.profile.Order, "path"))
+		opts.Priorities = cfg.profile.Priorities
+	}
+	if order := cfg.value("order"); order != "" {
+		// openArchives has checked it.
+		opts.Order, _ = plan.ParseOrder(order)
+	}
+	if priorities := cfg.list("priority"); priorities != nil {
+		opts.Priorities = priorities
+	}
+	if opts.Order == plan.ByDiskOffset && !cfg.sim {
+		opts.Offset = realfs.DiskOffset
+	}
+	// openArchives has checked the hash mode.
+	mode, _ := realfs.ParseHashMode(cfg.hash)
+	if opts.Bidirectional {
+		for _, fsys := range fss {
+			if base, ok := realfs.ReadBase(fsys.Root(), mode); ok {
+				opts.Base = base
+				break
+			}
+		}
+	}
+	for _, fsys := range fss {
+		history, _ := realfs.ReadHistory(fsys.Root(), mode)
+		opts.Histories = append(opts.Histories, history)
+	}
+	return opts
+}
+
+// storeState adds the content of the origin to the history of every copy, and stores the files the
+// archives agree on after a bidirectional sync in every archive, once a sync ran to the end without failures.
+// It has nothing to store without a plan; the caller reports why there is none.
+func storeState(cfg *config, fss []fs.FS, p *plan.Plan, complete bool) int {
+	if p == nil || cfg.sim || !complete {
+		return exitOK
+	}
+	mode, _ := realfs.ParseHashMode(cfg.hash)
+	code := exitOK
+	for i, fsys := range fss {
+		if i > 0 && p.History != nil {
+			if err := realfs.StoreHistory(fsys.Root(), mode, p.History); err != nil {
+				fmt.Fprintf(os.Stderr, "dup: failed to store the history of %s: %v\n", fsys.Root(), err)
+				code = exitFailed
+			}
+		}
+		if p.Agreed != nil {
+			if err := realfs.StoreBase(fsys.Root(), mode, p.Agreed); err != nil {
+				fmt.Fprintf(os.Stderr, "dup: failed to store the base of %s: %v\n", fsys.Root(), err)
+				code = exitFailed
+			}
+		}
+	}
+	return code
+}
+
+// runHeadless runs headless.Run with the -quiet and -events flags of the command.
+func runHeadless(cfg *config, fss []fs.FS, lc *lifecycle.Lifecycle, opts headless.Options) int {
+	events := cfg.value("events")
+	if events != "" && events != "jsonl" {
+		return usageError(fmt.Sprintf("unknown event format %q", events))
+	}
+	opts.Quiet = cfg.flag("quiet")
+	opts.Progress = os.Stderr
+	var jsonlWriter *jsonl.Writer
+	if events == "jsonl" {
+		jsonlWriter = jsonl.New(os.Stdout, roots(fss))
+		opts.Sinks = append(opts.Sinks, jsonlWriter)
+	}
+	summary := headless.Run(fss, lc, opts)
+	if jsonlWriter != nil {
+		summary.Print(os.Stderr)
+		jsonlWriter.Summary(jsonl.Summary{
+			Renamed:     summary.Renamed,
+			Copied:      summary.Copied,
+			CopiedBytes: summary.CopiedSize,
+			Failed:      summary.Failed,
+			Interrupted: summary.Interrupted,
+		})
+	} else {
+		summary.Print(os.Stdout)
+	}
+	if summary.Err != nil {
+		return exitFailed
+	}
+	code := storeState(cfg, fss, summary.Plan, !summary.Interrupted && summary.Failed == 0)
+	if summary.Interrupted || summary.Failed > 0 {
+		return exitFailed
+	}
+	return code
+}
+
+func runDryRun(cfg *config, args []string, events string) int {
+	fss, lc, code := openArchives(cfg, args, 2, true, realfs.Options{ReadOnly: true})
+	if fss == nil {
+		return code
+	}
+	snapshots, _, ok := scan(fss, lc)
+	if !ok {
+		return exitFailed
+	}
+	p := plan.Make(snapshots, cfg.planOptions(fss))
+	report := dryrun.Make(p)
+	for _, trip := range guard.Check(p, cfg.limits()) {
+		i := slices.IndexFunc(report.Archives, func(a dryrun.Archive) bool { return a.Root == trip.Root })
+		report.Archives[i].Problems = append(report.Archives[i].Problems, trip.Reason+"; sync would refuse without -force")
+	}
+	if events == "jsonl" {
+		jsonl.New(os.Stdout, roots(fss)).DryRun(report)
+	} else {
+		report.Print(os.Stdout)
+	}
+	if !report.OK() {
+		return exitFailed
+	}
+	return exitOK
+}
+
+func runScan(cfg *config, args []string) int {
+	fss, lc, code := openArchives(cfg, args, 1, false, realfs.Options{})
+	if fss == nil {
+		return code
+	}
+	snapshots, _, ok := scan(fss, lc)
+	if !ok {
+		return exitFailed
+	}
+	for _, snapshot := range snapshots {
+		fp := fs.Fingerprints(snapshot.Files)["."]
+		fmt.Printf("%8d files %10s  %s  %s\n", fp.Files, fs.FormatSize(fp.Size), fp.Hash, snapshot.Root)
+	}
+	return exitOK
+}
+
+func runPlan(cfg *config, args []string) int {
+	// A plan may copy into archives sync would create, and leaves the hash caches alone.
+	fss, lc, code := openArchives(cfg, args, 2, true, realfs.Options{ReadOnly: true})
+	if fss == nil {
+		return code
+	}
+	snapshots, _, ok := scan(fss, lc)
+	if !ok {
+		return exitFailed
+	}
+	p := plan.Make(snapshots, cfg.planOptions(fss))
+	printPlan(p)
+	if out := cfg.value("out"); out != "" {
+		if err := writePlan(out, p); err != nil {
+			fmt.Fprintf(os.Stderr, "dup: failed to write plan: %v\n", err)
+			return exitFailed
+		}
+	}
+	return exitOK
+}
+
+func writePlan(path string, p *plan.Plan) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := p.Write(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func runApply(cfg *config, args []string) int {
+	if len(args) != 1 {
+		return usageError("expected a plan file")
+	}
+	file, err := os.Open(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dup: failed to read plan: %v\n", err)
+		return exitFailed
+	}
+	p, err := plan.Read(file)
+	file.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dup: failed to read plan %q: %v\n", args[0], err)
+		return exitFailed
+	}
+
+	roots := []string{}
+	for _, archive := range p.Archives {
+		roots = append(roots, archive.Root)
+	}
+	fss, lc, code := openArchives(cfg, roots, 2, true, realfs.Options{})
+	if fss == nil {
+		return code
+	}
+	refused := false
+	code = runHeadless(cfg, fss, lc, headless.Options{Plan: func(e *engine.Engine) *plan.Plan {
+		valid, stale := plan.Validate(p, e.Snapshots())
+		for _, entry := range stale {
+			fmt.Fprintf(os.Stderr, "stale     %s\n", entry)
+		}
+		if len(stale) > 0 && !cfg.flag("skip-stale") {
+			fmt.Fprintf(os.Stderr, "dup: refusing to apply a plan with %d stale entries; make a new plan or use -skip-stale\n", len(stale))
+			refused = true
+			return nil
+		}
+		if !checkLimits(cfg, valid) {
+			refused = true
+			return nil
+		}
+		return valid
+	}})
+	if refused {
+		return exitFailed
+	}
+	return code
+}
+
+func runRestore(cfg *config, args []string) int {
+	paths := cfg.list("path")
+	for i, path := range paths {
+		paths[i] = filepath.Clean(path)
+		if !filepath.IsLocal(paths[i]) {
+			return usageError(fmt.Sprintf("%q is not a path in the archive", path))
+		}
+	}
+	if cfg.flag("dry-run") {
+		fss, lc, code := openArchives(cfg, args, 2, true, realfs.Options{ReadOnly: true})
+		if fss == nil {
+			return code
+		}
+		snapshots, _, ok := scan(fss, lc)
+		if !ok {
+			return exitFailed
+		}
+		printPlan(plan.Restore(snapshots, paths, cfg.planOptions(fss).Histories))
+		return exitOK
+	}
+
+	fss, lc, code := openArchives(cfg, args, 2, true, realfs.Options{})
+	if fss == nil {
+		return code
+	}
+	return runHeadless(cfg, fss, lc, headless.Options{Plan: func(e *engine.Engine) *plan.Plan {
+		return plan.Restore(e.Snapshots(), paths, cfg.planOptions(fss).Histories)
+	}})
+}
+
+func runStatus(cfg *config, args []string) int {
+	fss, lc, code := openArchives(cfg, args, 2, false, realfs.Options{})
+	if fss == nil {
+		return code
+	}
+	snapshots, _, ok := scan(fss, lc)
+	if !ok {
+		return exitFailed
+	}
+	opts := cfg.planOptions(fss)
+	return printStatus(plan.Make(snapshots, opts), opts.Additive)
+}
+
+func runVerify(cfg *config, args []string) int {
+	fss, lc, code := openArchives(cfg, args, 2, false, realfs.Options{Rehash: true})
+	if fss == nil {
+		return code
+	}
+	snapshots, corrupted, ok := scan(fss, lc)
+	if !ok {
+		return exitFailed
+	}
+	opts := cfg.planOptions(fss)
+	code = printStatus(plan.Make(snapshots, opts), opts.Additive)
+	if printCorrupted(snapshots, corrupted) {
+		return exitCorrupted
+	}
+	return code
+}
+
+func runScrub(cfg *config, args []string) int {
+	fss, lc, code := openArchives(cfg, args, 1, false, realfs.Options{Rehash: true})
+	if fss == nil {
+		return code
+	}
+	snapshots, corrupted, ok := scan(fss, lc)
+	if !ok {
+		return exitFailed
+	}
+	if printCorrupted(snapshots, corrupted) {
+		return exitCorrupted
+	}
+	fmt.Println("All files match their cached hashes.")
+	return exitOK
+}
+
+func runDedup(cfg *config, args []string) int {
+	fss, lc, code := openArchives(cfg, args, 1, false, realfs.Options{})
+	if fss == nil {
+		return code
+	}
+	snapshots, _, ok := scan(fss, lc)
+	if !ok {
+		return exitFailed
+	}
+	for _, snapshot := range snapshots {
+		byHash := map[string][]fs.FileMeta{}
+		for _, file := range snapshot.Files {
+			byHash[file.Hash] = append(byHash[file.Hash], file)
+		}
+		groups := [][]fs.FileMeta{}
+		wasted := 0
+		for _, files := range byHash {
+			if len(files) < 2 {
+				continue
+			}
+			slices.SortFunc(files, func(a, b fs.FileMeta) int { return strings.Compare(a.Path, b.Path) })
+			groups = append(groups, files)
+			wasted += files[0].Size * (len(files) - 1)
+		}
+		slices.SortFunc(groups, func(a, b []fs.FileMeta) int { return strings.Compare(a[0].Path, b[0].Path) })
+
+		fmt.Printf("%s: %d groups of identical files, %s in duplicates\n", snapshot.Root, len(groups), fs.FormatSize(wasted))
+		for _, files := range groups {
+			fmt.Printf("  %s\n", fs.FormatSize(files[0].Size))
+			for _, file := range files {
+				fmt.Printf("    %s\n", file.Path)
+			}
+		}
+	}
+	return exitOK
+}
+
+func runInit(cfg *config, args []string) int {
+	fss, lc, code := openArchives(cfg, args, 1, true, realfs.Options{})
+	if fss == nil {
+		return code
+	}
+	snapshots, _, ok := scan(fss, lc)
+	if !ok {
+		return exitFailed
+	}
+	for _, snapshot := range snapshots {
+		fmt.Printf("initialized %s (%d files)\n", snapshot.Root, len(snapshot.Files))
+	}
+	return exitOK
+}
+
+func runProfiles(cfg *config, args []string) int {
+	profiles, err := cfg.load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dup: failed to read configuration: %v\n", err)
+		return exitFailed
+	}
+	names := slices.Sorted(maps.Keys(profiles.Profiles))
+	for _, name := range names {
+		profile := profiles.Profiles[name]
+		fmt.Printf("%s:\n", name)
+		fmt.Printf("  origin   %s\n", profile.Origin)
+		for _, copy := range profile.Copies {
+			fmt.Printf("  copy     %s\n", copy)
+		}
+		if len(profile.Ignore) > 0 {
+			fmt.Printf("  ignore   %s\n", strings.Join(profile.Ignore, " "))
+		}
+		if profile.Hash != "" {
+			fmt.Printf("  hash     %s\n", profile.Hash)
+		}
+		if profile.Conflict != "" {
+			fmt.Printf("  conflict %s\n", profile.Conflict)
+		}
+		if profile.Additive {
+			fmt.Printf("  additive\n")
+		}
+		if profile.Bidirectional {
+			fmt.Printf("  bidirectional\n")
+		}
+		if profile.PullNew {
+			fmt.Printf("  pull new files\n")
+		}
+		if profile.Order != "" {
+			fmt.Printf("  order    %s\n", profile.Order)
+		}
+		for _, pattern := range profile.Priorities {
+			fmt.Printf("  priority %s\n", pattern)
+		}
+		for _, rule := range profile.Conflicts {
+			fmt.Printf("  conflict %s for %s\n", rule.Policy, rule.Pattern)
+		}
+		for _, name := range slices.Sorted(maps.Keys(profile.Limits)) {
+			fmt.Printf("  limit    %s %d\n", name, profile.Limits[name])
+		}
+	}
+	return exitOK
+}
+
+func runHelp(cfg *config, args []string) int {
+	if len(args) == 0 {
+		printUsage()
+		return exitOK
+	}
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		return usageError(fmt.Sprintf("unknown command %q", args[0]))
+	}
+	flags := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	if cmd.flags != nil {
+		cmd.flags(flags)
+	}
+	flags.Bool("sim", false, "use simulated archives instead of real ones")
+	printCommandUsage(cmd, flags)
+	return exitOK
+}
+
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func roots(fss []fs.FS) []string {
+	var roots []string
+	for _, fsys := range fss {
+		roots = append(roots, fsys.Root())
+	}
+	return roots
+}
+
+// openArchives returns nil file systems and the exit code when the archives cannot be used.
+func openArchives(cfg *config, paths []string, minArchives int, create bool, opts realfs.Options) ([]fs.FS, *lifecycle.Lifecycle, int) {
+	lc := lifecycle.New()
+	if cfg.sim {
+		return []fs.FS{mockfs.New("origin", 0, lc), mockfs.New("copy 1", 1, lc), mockfs.New("copy 2", 2, lc)}, lc, exitOK
+	}
+	if len(paths) < minArchives {
+		return nil, nil, usageError(fmt.Sprintf("expected at least %d archives, got %d", minArchives, len(paths)))
+	}
+
+	if cfg.profile != nil {
+		opts.Ignore = cfg.profile.Ignore
+	}
+	if cfg.additive() && cfg.bidirectional() {
+		return nil, nil, usageError("a sync cannot be both additive and bidirectional")
+	}
+	if order := cfg.value("order"); order != "" {
+		if _, err := plan.ParseOrder(order); err != nil {
+			return nil, nil, usageError(err.Error())
+		}
+	}
+	var err error
+	opts.Hash, err = realfs.ParseHashMode(cfg.hash)
+	if err != nil {
+		return nil, nil, usageError(err.Error())
+	}
+
+	fss := make([]fs.FS, 0, len(paths))
+	for idx, path := range paths {
+		if create && !opts.ReadOnly {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				fmt.Fprintf(os.Stderr, "dup: failed to create archive: %v\n", err)
+				return nil, nil, exitFailed
+			}
+		}
+		absPath, err := realfs.AbsPath(path)
+		if create && errors.Is(err, iofs.ErrNotExist) {
+			// A read-only run scans the archive it would have created as empty.
+			absPath, err = filepath.Abs(path)
+		}
+		path = absPath
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "dup: failed to open archive: %v\n", err)
+			return nil, nil, exitFailed
+		}
+		fss = append(fss, realfs.New(path, idx, opts, lc))
+	}
+	return fss, lc, exitOK
+}
+
+type corruptedFiles []fs.FileCorrupted
+
+// scan hashes the archives without a user interface; an interrupt stops it.
+func scan(fss []fs.FS, lc *lifecycle.Lifecycle) ([]plan.Snapshot, corruptedFiles, bool) {
+	e := engine.New(fss, lc)
+	e.Subscribe(bus.SinkFunc(engine.LogEvent))
+	var corrupted corruptedFiles
+	e.Subscribe(bus.SinkFunc(func(event any) {
+		if event, ok := event.(fs.FileCorrupted); ok {
+			corrupted = append(corrupted, event)
+		}
+	}))
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+	go func() {
+		select {
+		case <-interrupts:
+			e.Stop()
+		case <-e.Done():
+		}
+	}()
+
+	ok := e.Scan()
+	var snapshots []plan.Snapshot
+	if ok {
+		snapshots = e.Snapshots()
+	}
+	e.Stop()
+	return snapshots, corrupted, ok
+}
+
+func printPlan(p *plan.Plan) {
+	if p.Identical() {
+		fmt.Println("All archives are identical, nothing to do.")
+		return
+	}
+	for _, archive := range p.Archives {
+		if len(archive.Renames) == 0 && len(archive.Copies) == 0 {
+			continue
+		}
+		fmt.Printf("%s:\n", archive.Root)
+		for _, rename := range archive.Renames {
+			fmt.Printf("  %-8s %s -> %s\n", rename.Action, rename.SourcePath, rename.DestinationPath)
+		}
+		for _, copy := range archive.Copies {
+			fmt.Printf("  %-8s %s (%s) -> %s\n", "copy", copy.Path, fs.FormatSize(copy.Size), strings.Join(copy.ToRoots, ", "))
+		}
+	}
+	for _, decision := range p.Decisions {
+		fmt.Printf("conflict  %s\n", decision)
+	}
+	for _, file := range p.NewFiles {
+		fmt.Printf("new       %s\n", file)
+	}
+}
+
+// printStatus reports every copy; additive copies are complete when they hold every origin file.
+func printStatus(p *plan.Plan, additive bool) int {
+	if p.Identical() {
+		fp := p.Fingerprints[0]
+		fmt.Printf("All archives are identical: %s (%d files)\n", fp.Hash, fp.Files)
+		return exitOK
+	}
+	code := exitOK
+	for i, archive := range p.Archives[1:] {
+		copies, size := 0, 0
+		for _, source := range p.Archives {
+			for _, copy := range source.Copies {
+				if slices.Contains(copy.ToRoots, archive.Root) {
+					copies++
+					size += copy.Size
+				}
+			}
+		}
+		if p.Fingerprints[i+1] == p.Fingerprints[0] {
+			fmt.Printf("identical       %s\n", archive.Root)
+		} else if additive && copies == 0 && len(p.Decisions) == 0 {
+			fmt.Printf("complete        %s\n", archive.Root)
+		} else {
+			fmt.Printf("differs         %s: %d renames, %d files (%s) missing\n", archive.Root, len(archive.Renames), copies, fs.FormatSize(size))
+			code = exitDiffer
+		}
+	}
+	return code
+}
+
+func printCorrupted(snapshots []plan.Snapshot, corrupted corruptedFiles) bool {
+	for _, file := range corrupted {
+		fmt.Printf("corrupted       %s\n", snapshots[file.Idx].Root+"/"+file.Path)
+	}
+	return len(corrupted) > 0
+}
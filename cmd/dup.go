@@ -1,25 +1,127 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"os/exec"
+	"strings"
 
-	"dup/app"
-	"dup/fs"
-	"dup/fs/mockfs"
-	"dup/fs/realfs"
-	"dup/lifecycle"
+	conf "dup/config"
+	"dup/guard"
+	"dup/plan"
 )
 
+// Exit codes
+const (
+	exitOK        = 0
+	exitFailed    = 1
+	exitUsage     = 2
+	exitDiffer    = 3
+	exitCorrupted = 4
+)
+
+const usage = `dup keeps copies of an archive identical to the origin archive.
+
+Usage:
+  dup [global flags] <command> [flags] [arguments]
+
+Commands:
+%s
+Global flags:
+  -log file     write a debug log to file (default $DUP_LOG)
+  -hash mode    hash mode: "quick" hashes the first and the last 256 KiB of a file,
+                "full" hashes the whole file (default "quick")
+  -config file  read archive profiles from file (default $XDG_CONFIG_HOME/dup/config.toml)
+
+Run "dup help <command>" for the flags of a command.
+An archive list always starts with the origin; every other archive is a copy.
+A single argument that is no folder names a profile and stands for its archives.
+
+Exit codes:
+  0  success
+  1  the command failed or some files could not be processed
+  2  invalid command line
+  3  archives differ (status, verify)
+  4  files no longer match their cached hashes (scrub, verify)
+`
+
+type command struct {
+	name    string
+	args    string
+	summary string
+	// archives tells whether the arguments are archives, which a profile name can stand for.
+	archives bool
+	flags    func(flags *flag.FlagSet)
+	run      func(cfg *config, args []string) int
+}
+
+type config struct {
+	hash       string
+	sim        bool
+	configPath string
+	profile    *conf.Profile
+	flags      *flag.FlagSet
+}
+
+// listFlag collects the values of a repeated flag.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// list returns the values of a repeated command flag.
+func (cfg *config) list(name string) []string {
+	if f := cfg.flags.Lookup(name); f != nil {
+		return *f.Value.(*listFlag)
+	}
+	return nil
+}
+
+// flag returns the value of a boolean command flag.
+func (cfg *config) flag(name string) bool {
+	return cfg.value(name) == "true"
+}
+
+// value returns the value of a command flag as a string.
+func (cfg *config) value(name string) string {
+	f := cfg.flags.Lookup(name)
+	if f == nil {
+		return ""
+	}
+	return f.Value.String()
+}
+
 func main() {
-	logName := os.Getenv("DUP_LOG")
-	if logName != "" {
-		logFile, err := os.Create(logName)
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	cfg := &config{}
+	global := flag.NewFlagSet("dup", flag.ContinueOnError)
+	global.SetOutput(io.Discard)
+	logName := global.String("log", os.Getenv("DUP_LOG"), "")
+	global.StringVar(&cfg.hash, "hash", "", "")
+	global.BoolVar(&cfg.sim, "sim", false, "")
+	global.StringVar(&cfg.configPath, "config", "", "")
+	if err := global.Parse(args); err != nil {
+		return usageError(err.Error())
+	}
+	args = global.Args()
+
+	if *logName != "" {
+		logFile, err := os.Create(*logName)
 		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailed
 		}
 		defer logFile.Close()
 
@@ -29,26 +131,201 @@ func main() {
 		log.SetOutput(io.Discard)
 	}
 
-	var lc = lifecycle.New()
-	var fss []fs.FS
-	if len(os.Args) > 1 && os.Args[1] == "-sim" {
-		fss = []fs.FS{mockfs.New("origin", 0, lc), mockfs.New("copy 1", 1, lc), mockfs.New("copy 2", 2, lc)}
+	if len(args) == 0 && !cfg.sim {
+		printUsage()
+		return exitUsage
+	}
+
+	var cmd *command
+	if len(args) > 0 {
+		cmd = findCommand(args[0])
+	}
+	if cmd == nil {
+		// dup used to take archives and "-sim" without a command.
+		if len(args) > 0 && !isDir(args[0]) {
+			return usageError(fmt.Sprintf("unknown command %q", args[0]))
+		}
+		cmd = findCommand("sync")
 	} else {
-		fss = make([]fs.FS, 0, len(os.Args)-1)
-		for idx, path := range os.Args[1:] {
-			err := os.MkdirAll(path, 0755)
-			if err != nil {
-				log.Printf("Failed to scan archives: %W\n", err)
-				panic(err)
-			}
-			path, err := realfs.AbsPath(path)
-			if err != nil {
-				log.Printf("Failed to scan archives: %W\n", err)
-				panic(err)
+		args = args[1:]
+	}
+
+	flags := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	cfg.flags = flags
+	flags.SetOutput(os.Stderr)
+	flags.Usage = func() { printCommandUsage(cmd, flags) }
+	if cmd.flags != nil {
+		cmd.flags(flags)
+	}
+	flags.BoolVar(&cfg.sim, "sim", cfg.sim, "use simulated archives instead of real ones")
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	}
+	args = flags.Args()
+
+	if cmd.archives && len(args) == 1 && !cfg.sim {
+		profile, code := cfg.findProfile(args[0])
+		if code != exitOK {
+			return code
+		}
+		if profile != nil {
+			return cfg.runProfile(cmd, profile)
+		}
+	}
+	if cfg.hash == "" {
+		cfg.hash = "quick"
+	}
+	return cmd.run(cfg, args)
+}
+
+func (cfg *config) load() (*conf.Config, error) {
+	path := cfg.configPath
+	if path == "" {
+		return conf.Load(conf.DefaultPath())
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	return conf.Load(path)
+}
+
+// findProfile returns the profile called name, or nil when name is not a profile name.
+// A path or an existing folder is no profile name, and the configuration is not read for it.
+func (cfg *config) findProfile(name string) (*conf.Profile, int) {
+	if strings.ContainsRune(name, os.PathSeparator) || isDir(name) {
+		return nil, exitOK
+	}
+	profiles, err := cfg.load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dup: failed to read configuration: %v\n", err)
+		return nil, exitFailed
+	}
+	return profiles.Profiles[name], exitOK
+}
+
+// runProfile runs the command on the archives of the profile, between its hooks.
+func (cfg *config) runProfile(cmd *command, profile *conf.Profile) int {
+	if _, _, err := policies(profile); err != nil {
+		return usageError(fmt.Sprintf("profile %q: %v", profile.Name, err))
+	}
+	if profile.Order != "" {
+		if _, err := plan.ParseOrder(profile.Order); err != nil {
+			return usageError(fmt.Sprintf("profile %q: %v", profile.Name, err))
+		}
+	}
+	cfg.profile = profile
+	if cfg.hash == "" {
+		cfg.hash = profile.Hash
+	}
+	if cfg.hash == "" {
+		cfg.hash = "quick"
+	}
+
+	if err := runHook(profile, cmd, "pre", profile.Hooks.Pre, exitOK); err != nil {
+		fmt.Fprintf(os.Stderr, "dup: pre hook of profile %q failed: %v\n", profile.Name, err)
+		return exitFailed
+	}
+	code := cmd.run(cfg, profile.Archives())
+	if err := runHook(profile, cmd, "post", profile.Hooks.Post, code); err != nil {
+		fmt.Fprintf(os.Stderr, "dup: post hook of profile %q failed: %v\n", profile.Name, err)
+		if code == exitOK {
+			code = exitFailed
+		}
+	}
+	return code
+}
+
+// policies returns the conflict policy of the profile and its rules by path pattern.
+func policies(profile *conf.Profile) (plan.Policy, []plan.Rule, error) {
+	policy := plan.OriginWins
+	if profile.Conflict != "" {
+		var err error
+		if policy, err = plan.ParsePolicy(profile.Conflict); err != nil {
+			return 0, nil, err
+		}
+	}
+	var rules []plan.Rule
+	for _, rule := range profile.Conflicts {
+		rulePolicy, err := plan.ParsePolicy(rule.Policy)
+		if err != nil {
+			return 0, nil, fmt.Errorf("%q: %w", rule.Pattern, err)
+		}
+		rules = append(rules, plan.Rule{Pattern: rule.Pattern, Policy: rulePolicy})
+	}
+	return policy, rules, nil
+}
+
+// limits returns the changes a sync may make without confirmation: none are checked with -force,
+// and the profile overrides the defaults.
+func (cfg *config) limits() guard.Limits {
+	if cfg.flag("force") {
+		return guard.Limits{}
+	}
+	limits := guard.DefaultLimits
+	if cfg.profile != nil {
+		for name, limit := range cfg.profile.Limits {
+			switch name {
+			case "set_aside":
+				limits.SetAside = limit
+			case "conflicts":
+				limits.Conflicts = limit
+			case "encrypted":
+				limits.Encrypted = limit
 			}
-			fss = append(fss, realfs.New(path, idx, lc))
 		}
 	}
+	return limits
+}
+
+// runHook runs a hook with sh, passing the profile, the command and its exit code in the environment.
+func runHook(profile *conf.Profile, cmd *command, name, hook string, code int) error {
+	if hook == "" {
+		return nil
+	}
+	log.Printf("running %s hook of profile %q: %s\n", name, profile.Name, hook)
+	c := exec.Command("sh", "-c", hook)
+	c.Stdout = os.Stderr
+	c.Stderr = os.Stderr
+	c.Env = append(os.Environ(),
+		"DUP_PROFILE="+profile.Name,
+		"DUP_COMMAND="+cmd.name,
+		fmt.Sprintf("DUP_EXIT=%d", code),
+	)
+	return c.Run()
+}
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+func printUsage() {
+	b := strings.Builder{}
+	for _, cmd := range commands {
+		fmt.Fprintf(&b, "  %-8s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(os.Stderr, usage, b.String())
+}
+
+func printCommandUsage(cmd *command, flags *flag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "Usage: dup %s [flags] %s\n\n%s\n", cmd.name, cmd.args, cmd.summary)
+	fmt.Fprintln(os.Stderr, "\nFlags:")
+	flags.PrintDefaults()
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
 
-	app.Run(fss, lc)
+func usageError(msg string) int {
+	fmt.Fprintf(os.Stderr, "dup: %s\nRun \"dup help\" for usage.\n", msg)
+	return exitUsage
 }
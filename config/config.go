@@ -0,0 +1,381 @@
+// Package config reads named archive profiles from a configuration file.
+//
+// The file is a small subset of TOML: tables, strings, string arrays, integers and booleans.
+//
+//	[profiles.photos]
+//	origin = "/Volumes/Origin/Photos"
+//	copies = ["/Volumes/Copy 1/Photos", "/Volumes/Copy 2/Photos"]
+//	ignore = ["*.tmp", "Thumbs.db", "cache/"]
+//	hash = "full"
+//	conflict = "origin-wins"
+//	additive = false
+//	bidirectional = false
+//	pull_new = false
+//	order = "disk"
+//	priorities = ["documents/", "*.pdf"]
+//
+//	[profiles.photos.conflicts]
+//	"*.xmp" = "newest-wins"
+//	"edits/" = "keep-both"
+//
+//	[profiles.photos.limits]
+//	set_aside = 5
+//	conflicts = 100
+//	encrypted = 20
+//
+//	[profiles.photos.hooks]
+//	pre = "mount /Volumes/Copy 1"
+//	post = "umount /Volumes/Copy 1"
+package config
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type Config struct {
+	Profiles map[string]*Profile
+}
+
+type Profile struct {
+	Name   string
+	Origin string
+	Copies []string
+	// Ignore holds glob patterns matched against file names and archive-relative paths.
+	// Patterns ending with a slash match folders only.
+	Ignore []string
+	// Hash is the hash mode, "quick" or "full".
+	Hash string
+	// Conflict names the policy for files that differ between the origin and a copy.
+	Conflict string
+	// Conflicts name the policies for the files matching patterns, in the order of the file.
+	Conflicts []ConflictRule
+	// Additive copies only ever gain files.
+	Additive bool
+	// Bidirectional spreads changes made to any archive to the others.
+	Bidirectional bool
+	// PullNew copies files that are new in a copy into the origin.
+	PullNew bool
+	// Limits override the changes a sync may make without confirmation, by name.
+	Limits map[string]int
+	// Order names the order of the copies; files matching Priorities are copied first.
+	Order      string
+	Priorities []string
+	Hooks      Hooks
+}
+
+type ConflictRule struct {
+	Pattern string
+	Policy  string
+}
+
+// Hooks are shell commands run before and after every command on the profile.
+type Hooks struct {
+	Pre  string
+	Post string
+}
+
+// Archives returns the origin followed by the copies.
+func (p *Profile) Archives() []string {
+	return append([]string{p.Origin}, p.Copies...)
+}
+
+// DefaultPath returns $XDG_CONFIG_HOME/dup/config.toml, or ~/.config/dup/config.toml.
+func DefaultPath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "dup", "config.toml")
+}
+
+// Load reads the configuration file; a missing file yields an empty configuration.
+func Load(path string) (*Config, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &Config{Profiles: map[string]*Profile{}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	cfg, err := Parse(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func Parse(r io.Reader) (*Config, error) {
+	cfg := &Config{Profiles: map[string]*Profile{}}
+	var table []string
+
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: malformed table header", lineNo)
+			}
+			table = splitKey(strings.TrimSpace(line[1 : len(line)-1]))
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", lineNo)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		for strings.HasPrefix(value, "[") && strings.Count(value, "[") > strings.Count(value, "]") && scanner.Scan() {
+			lineNo++
+			value += " " + strings.TrimSpace(stripComment(scanner.Text()))
+		}
+
+		parsed, err := parseValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		if err := cfg.set(append(table, splitKey(key)...), parsed); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for name, profile := range cfg.Profiles {
+		if profile.Origin == "" {
+			return nil, fmt.Errorf("profile %q has no origin", name)
+		}
+		if len(profile.Copies) == 0 {
+			return nil, fmt.Errorf("profile %q has no copies", name)
+		}
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) set(key []string, value any) error {
+	if len(key) < 3 || key[0] != "profiles" {
+		return fmt.Errorf("unknown setting %q", strings.Join(key, "."))
+	}
+	name := key[1]
+	profile := cfg.Profiles[name]
+	if profile == nil {
+		profile = &Profile{Name: name}
+		cfg.Profiles[name] = profile
+	}
+
+	var err error
+	if len(key) == 4 && key[2] == "limits" {
+		switch key[3] {
+		case "set_aside", "conflicts", "encrypted":
+		default:
+			return fmt.Errorf("unknown setting %q", strings.Join(key, "."))
+		}
+		limit, err := asInt(value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", strings.Join(key, "."), err)
+		}
+		if profile.Limits == nil {
+			profile.Limits = map[string]int{}
+		}
+		profile.Limits[key[3]] = limit
+		return nil
+	}
+	if len(key) == 4 && key[2] == "conflicts" {
+		rule := ConflictRule{Pattern: key[3]}
+		rule.Policy, err = asString(value)
+		profile.Conflicts = append(profile.Conflicts, rule)
+		if err != nil {
+			return fmt.Errorf("%s: %w", strings.Join(key, "."), err)
+		}
+		return nil
+	}
+	switch strings.Join(key[2:], ".") {
+	case "origin":
+		profile.Origin, err = asString(value)
+	case "copies":
+		profile.Copies, err = asStrings(value)
+	case "ignore":
+		profile.Ignore, err = asStrings(value)
+	case "hash":
+		profile.Hash, err = asString(value)
+	case "conflict":
+		profile.Conflict, err = asString(value)
+	case "additive":
+		profile.Additive, err = asBool(value)
+	case "bidirectional":
+		profile.Bidirectional, err = asBool(value)
+	case "pull_new":
+		profile.PullNew, err = asBool(value)
+	case "order":
+		profile.Order, err = asString(value)
+	case "priorities":
+		profile.Priorities, err = asStrings(value)
+	case "hooks.pre":
+		profile.Hooks.Pre, err = asString(value)
+	case "hooks.post":
+		profile.Hooks.Post, err = asString(value)
+	default:
+		return fmt.Errorf("unknown setting %q", strings.Join(key, "."))
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", strings.Join(key, "."), err)
+	}
+	return nil
+}
+
+func parseValue(value string) (any, error) {
+	switch {
+	case value == "true":
+		return true, nil
+	case value == "false":
+		return false, nil
+	case strings.HasPrefix(value, "["):
+		if !strings.HasSuffix(value, "]") {
+			return nil, errors.New("unterminated array")
+		}
+		result := []string{}
+		rest := strings.TrimSpace(value[1 : len(value)-1])
+		for rest != "" {
+			item, tail, err := cutString(rest)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, item)
+			rest = strings.TrimSpace(tail)
+			if rest != "" {
+				if !strings.HasPrefix(rest, ",") {
+					return nil, errors.New("expected comma between array items")
+				}
+				rest = strings.TrimSpace(rest[1:])
+			}
+		}
+		return result, nil
+	case strings.HasPrefix(value, `"`) || strings.HasPrefix(value, "'"):
+		str, rest, err := cutString(value)
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(rest) != "" {
+			return nil, fmt.Errorf("unexpected %q after string", rest)
+		}
+		return str, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q", value)
+	}
+	return n, nil
+}
+
+// cutString parses the quoted string at the start of s.
+func cutString(s string) (string, string, error) {
+	if strings.HasPrefix(s, "'") {
+		end := strings.Index(s[1:], "'")
+		if end < 0 {
+			return "", "", errors.New("unterminated string")
+		}
+		return s[1 : end+1], s[end+2:], nil
+	}
+	if !strings.HasPrefix(s, `"`) {
+		return "", "", fmt.Errorf("expected a string at %q", s)
+	}
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			str, err := strconv.Unquote(s[:i+1])
+			return str, s[i+1:], err
+		}
+	}
+	return "", "", errors.New("unterminated string")
+}
+
+// splitKey splits a dotted key; quoted parts may contain dots.
+func splitKey(key string) []string {
+	var parts []string
+	for {
+		key = strings.TrimSpace(key)
+		part, rest, found := strings.Cut(key, ".")
+		if str, tail, err := cutString(key); err == nil {
+			tail = strings.TrimSpace(tail)
+			part, rest, found = str, strings.TrimPrefix(tail, "."), strings.HasPrefix(tail, ".")
+		}
+		parts = append(parts, strings.TrimSpace(part))
+		if !found {
+			return parts
+		}
+		key = rest
+	}
+}
+
+// stripComment removes a trailing comment, leaving # inside strings alone.
+func stripComment(line string) string {
+	quote := byte(0)
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func asString(value any) (string, error) {
+	str, ok := value.(string)
+	if !ok {
+		return "", errors.New("expected a string")
+	}
+	return str, nil
+}
+
+func asInt(value any) (int, error) {
+	n, ok := value.(int)
+	if !ok || n < 0 {
+		return 0, errors.New("expected a number of at least 0")
+	}
+	return n, nil
+}
+
+func asBool(value any) (bool, error) {
+	b, ok := value.(bool)
+	if !ok {
+		return false, errors.New("expected true or false")
+	}
+	return b, nil
+}
+
+func asStrings(value any) ([]string, error) {
+	strs, ok := value.([]string)
+	if !ok {
+		return nil, errors.New("expected an array of strings")
+	}
+	return strs, nil
+}
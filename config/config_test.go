@@ -0,0 +1,78 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	file := `
+# Photos
+[profiles.photos]
+origin = "/origin" # the origin
+copies = [
+	"/copy 1",
+	'/copy#2',
+]
+hash = "full"
+additive = true
+priorities = ["docs/", "*.pdf"]
+
+[profiles.photos.conflicts]
+"*.xmp" = "newest-wins"
+"a.b/" = "keep-both"
+
+[profiles.photos.limits]
+set_aside = 10
+
+[profiles.photos.hooks]
+pre = "mount \"/copy 1\""
+`
+	cfg, err := Parse(strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Profile{
+		Name:       "photos",
+		Origin:     "/origin",
+		Copies:     []string{"/copy 1", "/copy#2"},
+		Hash:       "full",
+		Additive:   true,
+		Priorities: []string{"docs/", "*.pdf"},
+		Conflicts:  []ConflictRule{{"*.xmp", "newest-wins"}, {"a.b/", "keep-both"}},
+		Limits:     map[string]int{"set_aside": 10},
+		Hooks:      Hooks{Pre: `mount "/copy 1"`},
+	}
+	if got := cfg.Profiles["photos"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got profile\n %+v\nwant\n %+v", got, want)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	const profile = "[profiles.p]\norigin = \"/o\"\ncopies = [\"/c\"]\n"
+	tests := []struct {
+		name, file, err string
+	}{
+		{"unterminated string", profile + `hash = "full`, "line 4: unterminated string"},
+		{"unterminated array", profile + `ignore = ["a", "b"`, "line 4: unterminated array"},
+		{"missing comma", profile + `ignore = ["a" "b"]`, "line 4: expected comma between array items"},
+		{"unknown key", profile + `colour = "red"`, `line 4: unknown setting "profiles.p.colour"`},
+		{"unknown table", "[other]\nkey = 1\n", `line 2: unknown setting "other.key"`},
+		{"unknown limit", profile + "[profiles.p.limits]\nfiles = 1\n", `line 5: unknown setting "profiles.p.limits.files"`},
+		{"negative limit", profile + "[profiles.p.limits]\nconflicts = -1\n", "line 5: profiles.p.limits.conflicts: expected a number of at least 0"},
+		{"wrong type", profile + "additive = \"yes\"", "line 4: profiles.p.additive: expected true or false"},
+		{"malformed table", "[profiles.p\n", "line 1: malformed table header"},
+		{"no value", profile + "hash", "line 4: expected key = value"},
+		{"no origin", "[profiles.p]\ncopies = [\"/c\"]\n", `profile "p" has no origin`},
+		{"no copies", "[profiles.p]\norigin = \"/o\"\n", `profile "p" has no copies`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(test.file))
+			if err == nil || err.Error() != test.err {
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !(linux || darwin || freebsd)
+
+package dryrun
+
+import (
+	"errors"
+	"os"
+)
+
+// writable returns an error if dir is read-only; permissions are not checked further.
+func writable(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm()&0o200 == 0 {
+		return os.ErrPermission
+	}
+	return nil
+}
+
+// freeSpace cannot tell the free space on this system.
+func freeSpace(dir string) (int, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,22 @@
+//go:build linux || darwin || freebsd
+
+package dryrun
+
+import "syscall"
+
+// Access mode for syscall.Access.
+const writeOK = 0x2
+
+// writable returns an error unless the user may create files in dir.
+func writable(dir string) error {
+	return syscall.Access(dir, writeOK)
+}
+
+// freeSpace returns the bytes available to the user on the file system of dir.
+func freeSpace(dir string) (int, error) {
+	stat := syscall.Statfs_t{}
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int(stat.Bavail) * int(stat.Bsize), nil
+}
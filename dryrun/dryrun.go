@@ -0,0 +1,164 @@
+// Package dryrun reports what a plan would do to every archive and whether the archives can take it.
+package dryrun
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"dup/fs"
+	"dup/plan"
+)
+
+type Report struct {
+	Plan     *plan.Plan
+	Archives []Archive
+}
+
+type Archive struct {
+	Root          string   `json:"root"`
+	Moves         int      `json:"moves"`
+	MovedBytes    int      `json:"moved_bytes"`
+	Backups       int      `json:"backups"`
+	BackedUpBytes int      `json:"backed_up_bytes"`
+	Conflicts     int      `json:"conflicts"`
+	ConflictBytes int      `json:"conflict_bytes"`
+	Copies        int      `json:"copies"`
+	CopiedBytes   int      `json:"copied_bytes"`
+	FreeBytes     int      `json:"free_bytes"`
+	Writable      bool     `json:"writable"`
+	Problems      []string `json:"problems"`
+}
+
+// Make totals the plan per archive and checks free space and write permission where it changes something.
+func Make(p *plan.Plan) Report {
+	report := Report{Plan: p}
+	for _, archive := range p.Archives {
+		a := Archive{Root: archive.Root, Writable: true, Problems: []string{}}
+		for _, rename := range archive.Renames {
+			switch rename.Action {
+			case plan.Move:
+				a.Moves++
+				a.MovedBytes += rename.Size
+			case plan.Backup:
+				a.Backups++
+				a.BackedUpBytes += rename.Size
+			case plan.Conflict:
+				a.Conflicts++
+				a.ConflictBytes += rename.Size
+			}
+		}
+		for _, copy := range incoming(p, archive.Root) {
+			a.Copies++
+			a.CopiedBytes += copy.Size
+		}
+		if a.Copies > 0 || len(archive.Renames) > 0 {
+			a.check()
+		}
+		report.Archives = append(report.Archives, a)
+	}
+	return report
+}
+
+func (a *Archive) check() {
+	// A missing archive is created by sync, so check the closest existing parent.
+	dir := a.Root
+	for {
+		_, err := os.Stat(dir)
+		if err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if !errors.Is(err, iofs.ErrNotExist) || parent == dir {
+			a.Writable = false
+			a.Problems = append(a.Problems, fmt.Sprintf("cannot access %s: %v", a.Root, err))
+			return
+		}
+		dir = parent
+	}
+
+	if err := writable(dir); err != nil {
+		a.Writable = false
+		a.Problems = append(a.Problems, fmt.Sprintf("%s is not writable: %v", dir, err))
+	}
+
+	free, err := freeSpace(dir)
+	if err != nil {
+		a.Problems = append(a.Problems, fmt.Sprintf("cannot tell free space of %s: %v", dir, err))
+		return
+	}
+	a.FreeBytes = free
+	if a.CopiedBytes > a.FreeBytes {
+		a.Problems = append(a.Problems, fmt.Sprintf("needs %s but only %s is free",
+			fs.FormatSize(a.CopiedBytes), fs.FormatSize(a.FreeBytes)))
+	}
+}
+
+// incoming returns the copies into the archive.
+func incoming(p *plan.Plan, root string) []plan.Copy {
+	var result []plan.Copy
+	for _, archive := range p.Archives {
+		for _, copy := range archive.Copies {
+			if slices.Contains(copy.ToRoots, root) {
+				result = append(result, copy)
+			}
+		}
+	}
+	return result
+}
+
+// OK tells whether no copy has a problem.
+func (r Report) OK() bool {
+	for _, archive := range r.Archives {
+		if len(archive.Problems) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Print writes every rename and copy of the plan followed by the totals of each archive.
+func (r Report) Print(w io.Writer) {
+	if r.Plan.Identical() {
+		fmt.Fprintln(w, "All archives are identical, nothing to do.")
+		return
+	}
+	for i, archive := range r.Plan.Archives {
+		a := r.Archives[i]
+		if i == 0 && a.Copies == 0 && len(archive.Renames) == 0 {
+			continue
+		}
+		if i == 0 {
+			fmt.Fprintf(w, "%s (origin):\n", archive.Root)
+		} else {
+			fmt.Fprintf(w, "%s:\n", archive.Root)
+		}
+		for _, rename := range archive.Renames {
+			fmt.Fprintf(w, "  %-8s %s -> %s (%s)\n", rename.Action, rename.SourcePath, rename.DestinationPath, fs.FormatSize(rename.Size))
+		}
+		for _, copy := range incoming(r.Plan, archive.Root) {
+			fmt.Fprintf(w, "  %-8s %s (%s)\n", "copy", copy.Path, fs.FormatSize(copy.Size))
+		}
+		if i > 0 || a.Copies > 0 || len(archive.Renames) > 0 {
+			fmt.Fprintf(w, "  total    %d moves (%s), %d backups (%s), %d conflicts (%s), %d copies (%s)\n",
+				a.Moves, fs.FormatSize(a.MovedBytes), a.Backups, fs.FormatSize(a.BackedUpBytes),
+				a.Conflicts, fs.FormatSize(a.ConflictBytes), a.Copies, fs.FormatSize(a.CopiedBytes))
+		}
+		if a.FreeBytes > 0 {
+			fmt.Fprintf(w, "  free     %s\n", fs.FormatSize(a.FreeBytes))
+		}
+		for _, problem := range a.Problems {
+			fmt.Fprintf(w, "  problem  %s\n", problem)
+		}
+	}
+	for _, decision := range r.Plan.Decisions {
+		fmt.Fprintf(w, "conflict  %s\n", decision)
+	}
+	for _, file := range r.Plan.NewFiles {
+		fmt.Fprintf(w, "new       %s\n", file)
+	}
+}
@@ -0,0 +1,137 @@
+package dryrun
+
+import (
+	"bytes"
+	iofs "io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"dup/engine"
+	"dup/fs"
+	"dup/fs/realfs"
+	"dup/lifecycle"
+	"dup/plan"
+)
+
+// tree lists every entry under root with its size and modification time.
+func tree(t *testing.T, root string) map[string]string {
+	t.Helper()
+	result := map[string]string{}
+	err := filepath.WalkDir(root, func(path string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		result[path] = info.Mode().String() + " " + info.ModTime().Format(time.RFC3339Nano)
+		if !d.IsDir() {
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			result[path] += " " + string(content)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+// write creates the files with their content.
+func write(t *testing.T, files map[string]string) {
+	t.Helper()
+	for path, content := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDryRunOfRealArchivesNeverWrites(t *testing.T) {
+	dir := t.TempDir()
+	origin := filepath.Join(dir, "origin")
+	copy := filepath.Join(dir, "copy")
+	write(t, map[string]string{
+		filepath.Join(origin, "a", "new"): "new",
+		filepath.Join(origin, "b"):        "moved",
+		filepath.Join(copy, "old", "b"):   "moved",
+		filepath.Join(copy, "extra"):      "extra",
+	})
+	before := tree(t, dir)
+
+	lc := lifecycle.New()
+	opts := realfs.Options{ReadOnly: true}
+	e := engine.New([]fs.FS{realfs.New(origin, 0, opts, lc), realfs.New(copy, 1, opts, lc)}, lc)
+	if !e.Scan() {
+		t.Fatal("the scan was interrupted")
+	}
+	report := Make(e.Plan(plan.Options{Backup: engine.BackupName(time.Now())}))
+	e.Stop()
+	report.Print(&bytes.Buffer{})
+
+	if after := tree(t, dir); !reflect.DeepEqual(before, after) {
+		t.Errorf("the dry run changed the archives:\n before %v\n after  %v", before, after)
+	}
+	a := report.Archives[1]
+	if a.Moves != 1 || a.Backups != 1 || a.Copies != 1 || a.CopiedBytes != 3 {
+		t.Errorf("got report %+v", a)
+	}
+}
+
+func TestMakeNeverWrites(t *testing.T) {
+	dir := t.TempDir()
+	origin := filepath.Join(dir, "origin")
+	copy := filepath.Join(dir, "copy")
+	missing := filepath.Join(dir, "missing", "copy")
+	write(t, map[string]string{
+		filepath.Join(origin, "a", "new"): "new",
+		filepath.Join(origin, "b"):        "moved",
+		filepath.Join(copy, "old", "b"):   "moved",
+	})
+	before := tree(t, dir)
+
+	p := &plan.Plan{
+		Archives: []plan.Archive{
+			{Root: origin, Copies: []plan.Copy{
+				{Copy: fs.Copy{Path: "a/new", Hash: "new", ToRoots: []string{copy, missing}}, Size: 3},
+				{Copy: fs.Copy{Path: "b", Hash: "moved", ToRoots: []string{missing}}, Size: 5},
+			}},
+			{Root: copy, Renames: []plan.Rename{
+				{Rename: fs.Rename{SourcePath: "old/b", DestinationPath: "b"}, Action: plan.Move, Size: 5, Hash: "moved"},
+			}},
+			{Root: missing},
+		},
+		Fingerprints: []fs.Fingerprint{{Hash: "x"}, {Hash: "y"}, {Hash: "z"}},
+	}
+	report := Make(p)
+	report.Print(&bytes.Buffer{})
+
+	if after := tree(t, dir); !reflect.DeepEqual(before, after) {
+		t.Errorf("the dry run changed the archives:\n before %v\n after  %v", before, after)
+	}
+	if !report.OK() {
+		t.Errorf("got problems %v", report.Archives)
+	}
+	want := []Archive{
+		{Root: origin, Writable: true, Problems: []string{}},
+		{Root: copy, Moves: 1, MovedBytes: 5, Copies: 1, CopiedBytes: 3, Writable: true, Problems: []string{}},
+		{Root: missing, Copies: 2, CopiedBytes: 8, Writable: true, Problems: []string{}},
+	}
+	for i := range want {
+		got := report.Archives[i]
+		got.FreeBytes = 0
+		if !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("archive %d:\n got  %+v\n want %+v", i, got, want[i])
+		}
+	}
+}
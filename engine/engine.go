@@ -0,0 +1,552 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"dup/bus"
+	"dup/fs"
+	"dup/lifecycle"
+	"dup/plan"
+)
+
+type State int
+
+const (
+	Scanning State = iota
+	Renaming
+	Copying
+	Done
+)
+
+func (s State) String() string {
+	switch s {
+	case Scanning:
+		return "scanning"
+	case Renaming:
+		return "renaming"
+	case Copying:
+		return "copying"
+	case Done:
+		return "done"
+	}
+	return "unknown"
+}
+
+type ArchiveState int
+
+const (
+	ArchiveScanning ArchiveState = iota
+	ArchiveHashing
+	ArchiveHashed
+	ArchiveRenaming
+	ArchiveCopying
+	ArchiveSynced
+)
+
+const refreshRate = 100 * time.Millisecond
+
+// minMeasured is the number of bytes an archive must read while hashing for its read speed to count.
+const minMeasured = 16 << 20
+
+type Progress struct {
+	State    State
+	Archives []ArchiveProgress
+}
+
+// Executing is published when the engine starts executing a plan.
+type Executing struct {
+	Plan *plan.Plan
+}
+
+type progressKey struct{}
+
+// MergeKey and Merge make the bus deliver only the latest progress to slow subscribers.
+func (p Progress) MergeKey() any {
+	return progressKey{}
+}
+
+func (p Progress) Merge(later any) (any, bool) {
+	next, ok := later.(Progress)
+	return next, ok
+}
+
+type ArchiveProgress struct {
+	Root       string
+	State      ArchiveState
+	Size       int
+	Done       int
+	FilePath   string
+	FileSize   int
+	FileCopied int
+	Failed     int
+	// Renamed counts the renames done in the archive, Copied and CopiedSize the files copied into it.
+	Renamed    int
+	Copied     int
+	CopiedSize int
+}
+
+// Engine scans archives, plans and executes the sync.
+// All events are processed serially by a single goroutine which owns the engine state.
+// File system events and progress are published on a bus for any number of subscribers.
+type Engine struct {
+	archives []*archive
+	lc       *lifecycle.Lifecycle
+	bus      *bus.Bus
+	events   chan any
+	requests chan func()
+	done     chan struct{}
+	hashed   chan struct{}
+	synced   chan struct{}
+	state    State
+	stopped  bool
+	plan     *plan.Plan
+	syncing  int
+}
+
+type archive struct {
+	fs fs.FS
+	ArchiveProgress
+	files map[string]*fs.FileMeta
+	// speed is the read speed measured while hashing in bytes per second, 0 if too little was read.
+	speed float64
+	// copies hold the sizes of the files copied to the archive, by path.
+	copies map[string]int
+	// renaming is set until the renames of the archive are done, and copying by the archives
+	// that have started copying into it.
+	renaming bool
+	copying  map[int]bool
+	// renames hold the destination of every planned rename by source path, and outgoing
+	// the planned copies from the archive by path, to track the files as the sync goes.
+	renames  map[string]string
+	outgoing map[string]plan.Copy
+}
+
+func New(fss []fs.FS, lc *lifecycle.Lifecycle) *Engine {
+	e := &Engine{
+		lc:       lc,
+		bus:      bus.New(refreshRate),
+		events:   make(chan any, 256),
+		requests: make(chan func()),
+		done:     make(chan struct{}),
+		hashed:   make(chan struct{}),
+		synced:   make(chan struct{}),
+	}
+	for _, fsys := range fss {
+		e.archives = append(e.archives, &archive{
+			fs:              fsys,
+			ArchiveProgress: ArchiveProgress{Root: fsys.Root()},
+			files:           map[string]*fs.FileMeta{},
+			copying:         map[int]bool{},
+		})
+	}
+	// The engine needs every event to track the archives.
+	e.bus.SubscribeAll(bus.SinkFunc(e.receive))
+	go e.run()
+	return e
+}
+
+// BackupName names the backup folder of a sync started at the given time.
+func BackupName(t time.Time) string {
+	return t.Format("~~~060102-150405~~~")
+}
+
+// Send publishes an event from an fs.FS; it never blocks.
+func (e *Engine) Send(event any) {
+	e.bus.Send(event)
+}
+
+// Subscribe delivers file system events and engine progress to the sink.
+// Progress is coalesced, so a slow sink only sees the most recent one, and a sink that falls
+// far behind misses transient events.
+func (e *Engine) Subscribe(sink bus.Sink) {
+	e.bus.Subscribe(sink)
+	e.do(e.publish)
+}
+
+// Scan scans and hashes all archives and blocks until it is done.
+// It returns false if the engine was stopped first.
+func (e *Engine) Scan() bool {
+	for _, arc := range e.archives {
+		arc.fs.Scan(e)
+	}
+	select {
+	case <-e.hashed:
+		return true
+	case <-e.done:
+		return false
+	}
+}
+
+// Snapshots returns the scanned content of every archive.
+func (e *Engine) Snapshots() []plan.Snapshot {
+	var snapshots []plan.Snapshot
+	e.do(func() {
+		for _, arc := range e.archives {
+			snapshot := plan.Snapshot{Root: arc.Root}
+			for _, file := range arc.files {
+				snapshot.Files = append(snapshot.Files, *file)
+			}
+			snapshots = append(snapshots, snapshot)
+		}
+	})
+	return snapshots
+}
+
+// Speeds returns the read speed of every archive measured while hashing, 0 where too little was read.
+func (e *Engine) Speeds() []float64 {
+	var speeds []float64
+	e.do(func() {
+		for _, arc := range e.archives {
+			speeds = append(speeds, arc.speed)
+		}
+	})
+	return speeds
+}
+
+// Plan analyzes scanned archives; unless opts sets the speeds, the measured ones are used.
+func (e *Engine) Plan(opts plan.Options) *plan.Plan {
+	if opts.Speeds == nil {
+		opts.Speeds = e.Speeds()
+	}
+	return plan.Make(e.Snapshots(), opts)
+}
+
+// Execute renames files in every archive and copies missing files from the archives that hold them.
+// The copies between two archives start as soon as both are done renaming.
+// It blocks until the sync is done and returns false if the engine was stopped first.
+// A plan for other archives is an error, and nothing is changed.
+func (e *Engine) Execute(p *plan.Plan) (bool, error) {
+	if err := e.check(p); err != nil {
+		return false, err
+	}
+	e.bus.Send(Executing{Plan: p})
+	e.do(func() {
+		e.plan = p
+		e.state = Renaming
+		for i, arc := range e.archives {
+			arc.renames = map[string]string{}
+			for _, rename := range p.Archives[i].Renames {
+				arc.renames[rename.SourcePath] = rename.DestinationPath
+			}
+			arc.outgoing = map[string]plan.Copy{}
+			for _, copy := range p.Archives[i].Copies {
+				arc.outgoing[copy.Path] = copy
+			}
+			if len(p.Archives[i].Renames) == 0 {
+				continue
+			}
+			arc.State = ArchiveRenaming
+			arc.Done = 0
+			arc.Size = len(p.Archives[i].Renames)
+			arc.renaming = true
+			e.syncing++
+			arc.fs.Sync(p.Archives[i].RenameCommands(), e)
+		}
+		e.copy()
+		if e.syncing == 0 {
+			e.state = Done
+			close(e.synced)
+		}
+		e.publish()
+	})
+	select {
+	case <-e.synced:
+		return true, nil
+	case <-e.done:
+		return false, nil
+	}
+}
+
+// check returns an error unless the plan is for the archives of the engine, in the same order.
+func (e *Engine) check(p *plan.Plan) error {
+	if len(p.Archives) != len(e.archives) {
+		return fmt.Errorf("the plan is for %d archives, not %d", len(p.Archives), len(e.archives))
+	}
+	for i, archive := range p.Archives {
+		if archive.Root != e.archives[i].Root {
+			return fmt.Errorf("the plan is for archive %q, not %q", archive.Root, e.archives[i].Root)
+		}
+		for _, copy := range archive.Copies {
+			for _, root := range copy.ToRoots {
+				if e.archive(root) == nil {
+					return fmt.Errorf("the plan copies %q to %q, which is not an archive", copy.Path, root)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Fingerprints returns the root fingerprint of every archive as scanned, with the renames
+// and copies done since applied.
+func (e *Engine) Fingerprints() []fs.Fingerprint {
+	var fingerprints []fs.Fingerprint
+	e.do(func() {
+		for _, arc := range e.archives {
+			files := make([]fs.FileMeta, 0, len(arc.files))
+			for _, file := range arc.files {
+				files = append(files, *file)
+			}
+			fingerprints = append(fingerprints, fs.Fingerprints(files)["."])
+		}
+	})
+	return fingerprints
+}
+
+// Stop interrupts scanning and copying, waits for the file systems to wind down and
+// stops the engine. It is safe to call more than once.
+func (e *Engine) Stop() {
+	e.lc.Stop()
+	select {
+	case e.requests <- e.stop:
+	case <-e.done:
+	}
+	<-e.done
+	e.bus.Close()
+}
+
+// Done is closed when the engine stops.
+func (e *Engine) Done() <-chan struct{} {
+	return e.done
+}
+
+func (e *Engine) do(request func()) {
+	processed := make(chan struct{})
+	select {
+	case e.requests <- func() { request(); close(processed) }:
+		<-processed
+	case <-e.done:
+	}
+}
+
+func (e *Engine) run() {
+	for !e.stopped {
+		select {
+		case event := <-e.events:
+			e.handle(event)
+			e.publish()
+		case request := <-e.requests:
+			request()
+		}
+	}
+	close(e.done)
+}
+
+func (e *Engine) receive(event any) {
+	if _, ok := event.(Progress); ok {
+		return
+	}
+	select {
+	case e.events <- event:
+	case <-e.done:
+	}
+}
+
+func (e *Engine) stop() {
+	e.stopped = true
+	e.state = Done
+	e.publish()
+}
+
+func (e *Engine) handle(event any) {
+	switch event := event.(type) {
+	case fs.FileMetas:
+		arc := e.archives[event.Idx]
+		for _, meta := range event.Metas {
+			arc.files[meta.Path] = &meta
+			if meta.Hash == "" {
+				arc.Size++
+			}
+		}
+
+	case fs.FileHashed:
+		arc := e.archives[event.Idx]
+		if file, ok := arc.files[event.Path]; ok {
+			file.Hash = event.Hash
+		}
+		arc.Done++
+		arc.State = ArchiveHashing
+
+	case fs.ArchiveHashed:
+		arc := e.archives[event.Idx]
+		arc.State = ArchiveHashed
+		if event.Read >= minMeasured && event.Reading > 0 {
+			arc.speed = float64(event.Read) / event.Reading.Seconds()
+		}
+		for _, arc := range e.archives {
+			if arc.State != ArchiveHashed {
+				return
+			}
+		}
+		close(e.hashed)
+
+	case fs.FileFailed:
+		if event.To != "" {
+			if arc := e.archive(event.To); arc != nil {
+				arc.Failed++
+			}
+		} else {
+			e.archives[event.Idx].Failed++
+		}
+
+	case fs.RenamingFile:
+		e.archives[event.Idx].Done++
+
+	case fs.FileRenamed:
+		arc := e.archives[event.Idx]
+		arc.Renamed++
+		if file, ok := arc.files[event.Path]; ok {
+			delete(arc.files, event.Path)
+			// Backups are no part of the archive, as for the scan.
+			if to := arc.renames[event.Path]; !backedUp(to) {
+				file.Path = to
+				arc.files[to] = file
+			}
+		}
+
+	case fs.FileCopied:
+		if arc := e.archive(event.To); arc != nil {
+			arc.Copied++
+			arc.CopiedSize += event.Size
+			copy := e.archives[event.Idx].outgoing[event.Path]
+			arc.files[event.Path] = &fs.FileMeta{Idx: slices.Index(e.archives, arc), Path: event.Path, Size: copy.Size, Hash: copy.Hash}
+		}
+
+	case fs.CopyingFile:
+		arc := e.archive(event.To)
+		if arc == nil {
+			break
+		}
+		arc.Done += event.Size
+		if arc.FilePath != event.Path {
+			arc.FilePath = event.Path
+			arc.FileSize = arc.copies[event.Path]
+			arc.FileCopied = 0
+		}
+		arc.FileCopied = min(arc.FileCopied+event.Size, arc.FileSize)
+		if arc.Done >= arc.Size {
+			arc.State = ArchiveSynced
+		}
+
+	case fs.Synced:
+		e.syncing--
+		if arc := e.archives[event.Idx]; arc.renaming {
+			// No copy from an archive starts before it is done renaming.
+			arc.renaming = false
+			arc.State = ArchiveSynced
+			e.copy()
+		}
+		if e.syncing == 0 && e.state != Done {
+			for _, arc := range e.archives {
+				if arc.State == ArchiveCopying {
+					arc.State = ArchiveSynced
+				}
+			}
+			e.state = Done
+			close(e.synced)
+		}
+	}
+}
+
+// backedUp tells whether a path lies in a backup folder.
+func backedUp(path string) bool {
+	return slices.ContainsFunc(strings.Split(path, "/"), func(name string) bool { return strings.HasPrefix(name, "~~~") })
+}
+
+// archive returns the archive at root, nil if there is none.
+func (e *Engine) archive(root string) *archive {
+	for _, arc := range e.archives {
+		if arc.Root == root {
+			return arc
+		}
+	}
+	return nil
+}
+
+// copy starts the copies from every archive that is done renaming into the archives that are done renaming
+// and have not started receiving from it, all in one sync so that each file is read once.
+// Progress is reported by the archives the files are copied to.
+func (e *Engine) copy() {
+	for i, from := range e.archives {
+		if from.renaming {
+			continue
+		}
+		var ready []string
+		for _, to := range e.archives {
+			if !to.renaming && !to.copying[i] {
+				ready = append(ready, to.Root)
+			}
+		}
+		var commands []any
+		var receiving []string
+		for _, copy := range e.plan.Archives[i].Copies {
+			var toRoots []string
+			for _, root := range copy.ToRoots {
+				if slices.Contains(ready, root) {
+					toRoots = append(toRoots, root)
+					if !slices.Contains(receiving, root) {
+						receiving = append(receiving, root)
+					}
+				}
+			}
+			if len(toRoots) > 0 {
+				copy.ToRoots = toRoots
+				commands = append(commands, copy.Copy)
+			}
+		}
+		if len(commands) == 0 {
+			continue
+		}
+		for _, root := range receiving {
+			to := e.archive(root)
+			if len(to.copying) == 0 {
+				e.startReceiving(to)
+			}
+			to.copying[i] = true
+		}
+		e.state = Copying
+		e.syncing++
+		from.fs.Sync(commands, e)
+	}
+}
+
+// startReceiving makes the archive report the progress of the copies into it.
+func (e *Engine) startReceiving(arc *archive) {
+	arc.State = ArchiveCopying
+	arc.Done = 0
+	arc.Size = 0
+	arc.copies = map[string]int{}
+	for _, archive := range e.plan.Archives {
+		for _, copy := range archive.Copies {
+			if slices.Contains(copy.ToRoots, arc.Root) {
+				arc.Size += copy.Size
+				arc.copies[copy.Path] = copy.Size
+			}
+		}
+	}
+}
+
+func (e *Engine) publish() {
+	progress := Progress{State: e.state}
+	for _, arc := range e.archives {
+		progress.Archives = append(progress.Archives, arc.ArchiveProgress)
+	}
+	e.bus.Send(progress)
+}
+
+// LogEvent logs file system events; progress is left out.
+func LogEvent(event any) {
+	switch event := event.(type) {
+	case Progress:
+	case fs.FileMetas:
+		log.Printf("event: %d: scanned %d files\n", event.Idx, len(event.Metas))
+	case Executing:
+		log.Printf("event: executing plan for %d archives\n", len(event.Plan.Archives))
+	default:
+		log.Printf("event: %#v\n", event)
+	}
+}
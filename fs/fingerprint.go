@@ -0,0 +1,106 @@
+package fs
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Fingerprint identifies a directory by the names, sizes and hashes of everything below it.
+type Fingerprint struct {
+	Hash  string
+	Size  int
+	Files int
+}
+
+// Fingerprints returns a fingerprint for every directory that holds files,
+// keyed by slash-separated path with "." for the archive root.
+// Directories with files that are not hashed yet get no fingerprint.
+func Fingerprints(metas []FileMeta) map[string]Fingerprint {
+	tree := fingerprintTree{
+		files:   map[string][]FileMeta{},
+		subdirs: map[string]map[string]struct{}{},
+		result:  map[string]Fingerprint{},
+	}
+	tree.subdirs["."] = map[string]struct{}{}
+	for _, meta := range metas {
+		dir := path.Dir(meta.Path)
+		tree.files[dir] = append(tree.files[dir], meta)
+		for dir != "." {
+			parent := path.Dir(dir)
+			if tree.subdirs[parent] == nil {
+				tree.subdirs[parent] = map[string]struct{}{}
+			}
+			tree.subdirs[parent][dir] = struct{}{}
+			dir = parent
+		}
+	}
+	tree.fingerprint(".")
+	return tree.result
+}
+
+// DirPaths returns the paths of fingerprinted directories with parents before their children.
+func DirPaths(fingerprints map[string]Fingerprint) []string {
+	paths := make([]string, 0, len(fingerprints))
+	for path := range fingerprints {
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return strings.Count(paths[i], "/") < strings.Count(paths[j], "/") ||
+			strings.Count(paths[i], "/") == strings.Count(paths[j], "/") && paths[i] < paths[j]
+	})
+	return paths
+}
+
+// InDir reports whether the slash-separated path is dir itself or lies below it.
+func InDir(filePath, dir string) bool {
+	return dir == "." || filePath == dir || strings.HasPrefix(filePath, dir+"/")
+}
+
+type fingerprintTree struct {
+	files   map[string][]FileMeta
+	subdirs map[string]map[string]struct{}
+	result  map[string]Fingerprint
+}
+
+func (tree *fingerprintTree) fingerprint(dir string) (Fingerprint, bool) {
+	lines := []string{}
+	complete := true
+	fp := Fingerprint{}
+
+	for _, file := range tree.files[dir] {
+		if file.Hash == "" {
+			complete = false
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("f %q %d %s", path.Base(file.Path), file.Size, file.Hash))
+		fp.Size += file.Size
+		fp.Files++
+	}
+	for subdir := range tree.subdirs[dir] {
+		sub, ok := tree.fingerprint(subdir)
+		if !ok {
+			complete = false
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("d %q %d %s", path.Base(subdir), sub.Size, sub.Hash))
+		fp.Size += sub.Size
+		fp.Files += sub.Files
+	}
+	if !complete {
+		return fp, false
+	}
+
+	sort.Strings(lines)
+	hash := sha256.New()
+	for _, line := range lines {
+		hash.Write([]byte(line))
+		hash.Write([]byte{'\n'})
+	}
+	fp.Hash = base64.RawURLEncoding.EncodeToString(hash.Sum(nil))
+	tree.result[dir] = fp
+	return fp, true
+}
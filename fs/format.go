@@ -0,0 +1,18 @@
+package fs
+
+import "fmt"
+
+// FormatSize formats a byte count for people, like "1.5 GiB".
+func FormatSize(size int) string {
+	const units = "KMGTPE"
+	if size < 1024 {
+		return fmt.Sprintf("%d B", size)
+	}
+	value := float64(size)
+	idx := -1
+	for value >= 1024 && idx < len(units)-1 {
+		value /= 1024
+		idx++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, units[idx])
+}
@@ -46,8 +46,19 @@ type FileHashed struct {
 	Hash string
 }
 
+// Transient lets the bus drop hashed files for sinks that fall far behind; the engine gets them all.
+func (FileHashed) Transient() {}
+
+type FileCorrupted struct {
+	Idx  int
+	Path string
+}
+
+// ArchiveHashed tells how many bytes were read to hash files and how long it took.
 type ArchiveHashed struct {
-	Idx int
+	Idx     int
+	Read    int
+	Reading time.Duration
 }
 
 type RenamingFile struct {
@@ -55,12 +66,59 @@ type RenamingFile struct {
 	Path string
 }
 
+func (RenamingFile) Transient() {}
+
+// CopyingFile reports Size more bytes of a file copied from archive Idx to the archive at To.
 type CopyingFile struct {
 	Idx  int
+	To   string
 	Path string
 	Size int
 }
 
+type copyingKey struct {
+	idx int
+	to  string
+}
+
+// MergeKey and Merge let progress of the same file be reported in larger steps.
+func (e CopyingFile) MergeKey() any {
+	return copyingKey{e.Idx, e.To}
+}
+
+func (e CopyingFile) Merge(later any) (any, bool) {
+	next, ok := later.(CopyingFile)
+	if !ok || next.Idx != e.Idx || next.To != e.To || next.Path != e.Path {
+		return nil, false
+	}
+	e.Size += next.Size
+	return e, true
+}
+
+func (CopyingFile) Transient() {}
+
+// FileRenamed reports a rename of archive Idx done.
+type FileRenamed struct {
+	Idx  int
+	Path string
+}
+
+// FileCopied reports a file copied in full from archive Idx to the archive at To.
+type FileCopied struct {
+	Idx  int
+	To   string
+	Path string
+	Size int
+}
+
+// FileFailed reports a file of archive Idx that could not be processed, or copied to the archive at To.
+type FileFailed struct {
+	Idx   int
+	To    string
+	Path  string
+	Error string
+}
+
 type Synced struct {
 	Idx int
 }
@@ -0,0 +1,23 @@
+package fs
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Match tells whether the glob pattern matches the archive-relative path.
+// A pattern without a slash matches the file name, otherwise the whole path;
+// a pattern ending with a slash matches folders only.
+func Match(pattern, path string, isDir bool) bool {
+	if strings.HasSuffix(pattern, "/") {
+		if !isDir {
+			return false
+		}
+		pattern = strings.TrimSuffix(pattern, "/")
+	}
+	if !strings.Contains(pattern, "/") {
+		path = filepath.Base(path)
+	}
+	matched, _ := filepath.Match(pattern, path)
+	return matched
+}
@@ -67,6 +67,10 @@ func (fsys *FS) sync(commands []any, events fs.Events) {
 				Idx:  fsys.idx,
 				Path: cmd.DestinationPath,
 			})
+			events.Send(fs.FileRenamed{
+				Idx:  fsys.idx,
+				Path: cmd.SourcePath,
+			})
 		case fs.Copy:
 			size := 0
 			for _, file := range archives["origin"] {
@@ -84,17 +88,28 @@ func (fsys *FS) sync(commands []any, events fs.Events) {
 				if fsys.lc.ShoudStop() {
 					return
 				}
-				events.Send(fs.CopyingFile{
-					Idx:  fsys.idx,
-					Path: cmd.Path,
-					Size: delta,
-				})
+				for _, root := range cmd.ToRoots {
+					events.Send(fs.CopyingFile{
+						Idx:  fsys.idx,
+						To:   root,
+						Path: cmd.Path,
+						Size: delta,
+					})
+				}
 				time.Sleep(time.Millisecond)
 				progress += delta
 				if progress >= size {
 					break
 				}
 			}
+			for _, root := range cmd.ToRoots {
+				events.Send(fs.FileCopied{
+					Idx:  fsys.idx,
+					To:   root,
+					Path: cmd.Path,
+					Size: size,
+				})
+			}
 		}
 	}
 	events.Send(fs.Synced{
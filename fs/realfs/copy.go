@@ -0,0 +1,353 @@
+package realfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"dup/fs"
+)
+
+// queueDepth is the number of chunks the reader may be ahead of the worker of a destination.
+const queueDepth = 8
+
+// errInterrupted ends a copy that was stopped before the end of the file.
+var errInterrupted = errors.New("interrupted")
+
+// offloadChunk is the amount of data the kernel copies between two progress events.
+const offloadChunk = 8 << 20
+
+// buffers hold bufSize buffers for reading, so that copying allocates none per chunk.
+var buffers = sync.Pool{New: func() any {
+	buf := make([]byte, bufSize)
+	return &buf
+}}
+
+// chunk is a pooled buffer shared by the workers of the destinations; the last one to be done with it returns it to the pool.
+type chunk struct {
+	buf  *[]byte
+	n    int
+	refs atomic.Int32
+}
+
+func (c *chunk) release() {
+	if c.refs.Add(-1) == 0 {
+		buffers.Put(c.buf)
+	}
+}
+
+// destination writes the files copied into an archive, one after the other, with a worker of its own
+// that goes at its own pace.
+type destination struct {
+	root string
+	jobs chan *job
+	// credits bound the chunks read for the destination and not yet written, whatever their files.
+	credits chan struct{}
+}
+
+func newDestination(root string, files int) *destination {
+	d := &destination{root: root, jobs: make(chan *job, files), credits: make(chan struct{}, queueDepth)}
+	for range queueDepth {
+		d.credits <- struct{}{}
+	}
+	return d
+}
+
+// job is a file to copy to a destination. The reader hands it the chunks of the file until the
+// destination runs out of credits, then closes chunks and leaves the worker to read the file on from resume.
+// resume is -1 when the chunks hold the whole file, and err tells why the reader stopped short.
+type job struct {
+	cmd    fs.Copy
+	dest   *destination
+	info   os.FileInfo
+	file   *os.File
+	chunks chan *chunk
+	resume int64
+	err    error
+}
+
+// copyFiles copies the files to their destinations. A file is read once for all of them
+// while each destination writes the files queued for it on its own, so that a slow or failing
+// destination holds back no other.
+func (fsys *FS) copyFiles(copies []fs.Copy, events fs.Events) {
+	fsys.lc.Started()
+	defer fsys.lc.Done()
+
+	files := map[string]int{}
+	for _, cmd := range copies {
+		for _, root := range cmd.ToRoots {
+			files[root]++
+		}
+	}
+	dests := map[string]*destination{}
+	var wg sync.WaitGroup
+	for root, n := range files {
+		d := newDestination(root, n)
+		dests[root] = d
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fsys.work(d, events)
+		}()
+	}
+	for _, cmd := range copies {
+		if fsys.lc.ShoudStop() {
+			break
+		}
+		log.Printf("copy %q to %q\n", cmd.Path, cmd.ToRoots)
+		fsys.copyFile(cmd, dests, events)
+	}
+	for _, d := range dests {
+		close(d.jobs)
+	}
+	wg.Wait()
+}
+
+// copyFile queues the file for every destination and reads it for those that take its chunks.
+// Within a file system it clones the file, or leaves the copy to the kernel where possible.
+// The holes of a sparse file stay holes.
+func (fsys *FS) copyFile(cmd fs.Copy, dests map[string]*destination, events fs.Events) {
+	source := filepath.Join(fsys.root, cmd.Path)
+	readFailed := func(err error) {
+		log.Printf("Error: failed to read from file %q: %#v\n", source, err)
+		for _, root := range cmd.ToRoots {
+			fsys.copyFailed(events, root, cmd.Path, err)
+		}
+	}
+	sourceFile, err := os.Open(source)
+	if err != nil {
+		readFailed(err)
+		return
+	}
+	defer sourceFile.Close()
+	info, err := sourceFile.Stat()
+	if err != nil {
+		readFailed(err)
+		return
+	}
+	sparse := isSparse(info)
+
+	var fed []*job
+	for _, root := range cmd.ToRoots {
+		fullPath := filepath.Join(root, cmd.Path)
+		_ = os.MkdirAll(filepath.Dir(fullPath), 0755)
+		// A file the scan left out may be in the way; it is kept rather than overwritten.
+		file, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			log.Printf("Error: failed to create file %q: %#v\n", fullPath, err)
+			fsys.copyFailed(events, root, cmd.Path, err)
+			continue
+		}
+		j := &job{cmd: cmd, dest: dests[root], info: info, file: file, chunks: make(chan *chunk, queueDepth), resume: -1}
+		switch {
+		case !sameDevice(file, info):
+			fed = append(fed, j)
+		case clone(file, sourceFile):
+			fsys.copying(events, root, cmd.Path, int(info.Size()))
+			close(j.chunks)
+		// The kernel copy may fill the holes of sparse files.
+		case kernelCopy && !sparse:
+			j.resume = 0
+			close(j.chunks)
+		default:
+			fed = append(fed, j)
+		}
+		j.dest.jobs <- j
+	}
+	if len(fed) > 0 {
+		fsys.feed(sourceFile, fed)
+	}
+	adviseDone(sourceFile)
+}
+
+// feed reads src once and hands each chunk to the jobs whose destinations have credit left.
+// A job without credit is behind: it is left to read the rest itself, and the reader goes on
+// with the others, or with the next file once it has left them all.
+func (fsys *FS) feed(src *os.File, jobs []*job) {
+	adviseSequential(src)
+	var offset int64
+	var err error
+	for len(jobs) > 0 {
+		if fsys.lc.ShoudStop() {
+			err = errInterrupted
+			break
+		}
+		buf := buffers.Get().(*[]byte)
+		var n int
+		n, err = src.Read(*buf)
+		if n > 0 {
+			taking := jobs[:0]
+			for _, j := range jobs {
+				select {
+				case <-j.dest.credits:
+					taking = append(taking, j)
+				default:
+					j.resume = offset
+					close(j.chunks)
+				}
+			}
+			jobs = taking
+			c := &chunk{buf: buf, n: n}
+			c.refs.Store(int32(len(jobs)))
+			for _, j := range jobs {
+				j.chunks <- c
+			}
+			if len(jobs) == 0 {
+				buffers.Put(buf)
+			}
+			offset += int64(n)
+		} else {
+			buffers.Put(buf)
+		}
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			break
+		}
+	}
+	for _, j := range jobs {
+		j.err = err
+		close(j.chunks)
+	}
+}
+
+// work copies the files queued for the destination until there are no more.
+func (fsys *FS) work(d *destination, events fs.Events) {
+	for j := range d.jobs {
+		err := fsys.write(j, func(n int) { fsys.copying(events, d.root, j.cmd.Path, n) })
+		fsys.finishCopy(j.cmd, d.root, j.file, j.info, err, events)
+	}
+}
+
+// write writes the chunks the reader handed to the job, then the rest of the file if the reader left it behind.
+func (fsys *FS) write(j *job, progress func(int)) error {
+	sparse := isSparse(j.info)
+	var err error
+	// A failed job still gives back the chunks and their credits.
+	for c := range j.chunks {
+		if err == nil {
+			err = writeChunk(j.file, (*c.buf)[:c.n], sparse)
+			if err == nil {
+				progress(c.n)
+			}
+		}
+		c.release()
+		j.dest.credits <- struct{}{}
+	}
+	if err == nil {
+		err = j.err
+	}
+	if err == nil && j.resume >= 0 {
+		err = fsys.catchUp(j, progress)
+	}
+	if err == nil && sparse {
+		// A hole at the end has been skipped, not written.
+		err = j.file.Truncate(j.info.Size())
+	}
+	return err
+}
+
+// catchUp copies the file of the job from resume on. It reads through a file of its own,
+// within the kernel unless the file is sparse.
+func (fsys *FS) catchUp(j *job, progress func(int)) error {
+	src, err := os.Open(filepath.Join(fsys.root, j.cmd.Path))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	adviseSequential(src)
+	defer adviseDone(src)
+	if _, err := src.Seek(j.resume, io.SeekStart); err != nil {
+		return err
+	}
+	if isSparse(j.info) {
+		buf := buffers.Get().(*[]byte)
+		defer buffers.Put(buf)
+		for {
+			if fsys.lc.ShoudStop() {
+				return errInterrupted
+			}
+			n, err := src.Read(*buf)
+			if n > 0 {
+				if err := writeChunk(j.file, (*buf)[:n], true); err != nil {
+					return err
+				}
+				progress(n)
+			}
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	size := j.info.Size()
+	for copied := j.resume; copied < size; {
+		if fsys.lc.ShoudStop() {
+			return errInterrupted
+		}
+		n, err := io.CopyN(j.file, src, min(offloadChunk, size-copied))
+		copied += n
+		progress(int(n))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copying reports bytes of a file copied to the destination root.
+func (fsys *FS) copying(events fs.Events, root, path string, n int) {
+	events.Send(fs.CopyingFile{Idx: fsys.idx, To: root, Path: path, Size: n})
+}
+
+// writeChunk writes the chunk at the offset of the file, skipping it if it is sparse and the chunk all zeros.
+func writeChunk(file *os.File, chunk []byte, sparse bool) error {
+	if sparse && isZero(chunk) {
+		_, err := file.Seek(int64(len(chunk)), io.SeekCurrent)
+		return err
+	}
+	n, err := file.Write(chunk)
+	if err == nil && n < len(chunk) {
+		err = errors.New("short write")
+	}
+	return err
+}
+
+var zeros = make([]byte, bufSize)
+
+func isZero(chunk []byte) bool {
+	for len(chunk) > 0 {
+		n := min(len(chunk), len(zeros))
+		if !bytes.Equal(chunk[:n], zeros[:n]) {
+			return false
+		}
+		chunk = chunk[n:]
+	}
+	return true
+}
+
+// isSparse tells whether the file takes less room on disk than its size, so it has holes.
+func isSparse(info os.FileInfo) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && stat.Blocks*512 < info.Size()
+}
+
+func sameDevice(file *os.File, info os.FileInfo) bool {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	a, ok := fileInfo.Sys().(*syscall.Stat_t)
+	b, ok2 := info.Sys().(*syscall.Stat_t)
+	return ok && ok2 && a.Dev == b.Dev
+}
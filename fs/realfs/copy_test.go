@@ -0,0 +1,327 @@
+package realfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"dup/fs"
+	"dup/lifecycle"
+)
+
+const benchmarkSize = 64 << 20
+
+// source writes a file of benchmarkSize bytes: random data, or with sparse a hole
+// with a random MiB in the middle.
+func source(tb testing.TB, sparse bool) string {
+	path := filepath.Join(tb.TempDir(), "source")
+	file, err := os.Create(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer file.Close()
+	data := make([]byte, benchmarkSize)
+	offset := int64(0)
+	if sparse {
+		data = data[:1<<20]
+		offset = benchmarkSize / 2
+	}
+	rand.Read(data)
+	if _, err := file.WriteAt(data, offset); err != nil {
+		tb.Fatal(err)
+	}
+	if err := file.Truncate(benchmarkSize); err != nil {
+		tb.Fatal(err)
+	}
+	return path
+}
+
+// plainCopy copies as dup did before the copy workers: a fresh buffer for every Read and a Write for every buffer.
+func plainCopy(sourcePath, dir string) error {
+	src, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(filepath.Join(dir, filepath.Base(sourcePath)))
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	for {
+		buf := make([]byte, bufSize)
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// copyFiles copies the file at sourcePath to every one of dirs as a sync does and returns its events.
+func copyFiles(sourcePath string, dirs ...string) []any {
+	r := newRecorder()
+	fsys := New(filepath.Dir(sourcePath), 0, Options{}, lifecycle.New())
+	fsys.copyFiles([]fs.Copy{{Path: filepath.Base(sourcePath), ToRoots: dirs}}, r)
+	close(r.events)
+	return r.wait(0)
+}
+
+func TestCopyFiles(t *testing.T) {
+	for _, sparse := range []bool{false, true} {
+		sourcePath := source(t, sparse)
+		dir := t.TempDir()
+		copyFiles(sourcePath, dir)
+		path := filepath.Join(dir, "source")
+
+		want, _ := os.ReadFile(sourcePath)
+		got, _ := os.ReadFile(path)
+		if !bytes.Equal(got, want) {
+			t.Errorf("sparse %v: the copy differs from the source", sparse)
+		}
+		sourceInfo, _ := os.Stat(sourcePath)
+		info, _ := os.Stat(path)
+		if isSparse(sourceInfo) && info.Sys().(*syscall.Stat_t).Blocks > 2*sourceInfo.Sys().(*syscall.Stat_t).Blocks {
+			t.Errorf("the holes of the source were filled: %d blocks, want %d", info.Sys().(*syscall.Stat_t).Blocks, sourceInfo.Sys().(*syscall.Stat_t).Blocks)
+		}
+	}
+}
+
+func TestStoppedCopyFails(t *testing.T) {
+	for _, sparse := range []bool{false, true} {
+		sourcePath := source(t, sparse)
+		dir := t.TempDir()
+		lc := lifecycle.New()
+		r := newRecorder()
+		r.sent = func(event any) {
+			if _, ok := event.(fs.CopyingFile); ok && !lc.ShoudStop() {
+				// Stop waits for the copy, so it cannot be called from within.
+				go lc.Stop()
+				for !lc.ShoudStop() {
+					runtime.Gosched()
+				}
+			}
+		}
+		New(filepath.Dir(sourcePath), 0, Options{}, lc).Sync([]any{fs.Copy{Path: "source", ToRoots: []string{dir}}}, r)
+
+		for _, event := range r.wait(0) {
+			switch event := event.(type) {
+			case fs.FileCopied:
+				// The file system cloned the file at once.
+			case fs.FileFailed:
+				if event.Error != errInterrupted.Error() {
+					t.Errorf("sparse %v: got error %v, want %v", sparse, event.Error, errInterrupted)
+				}
+				if _, err := os.Stat(filepath.Join(dir, "source")); err == nil {
+					t.Errorf("sparse %v: the interrupted copy was kept", sparse)
+				}
+			}
+		}
+	}
+}
+
+func TestCopyToSeveralDestinations(t *testing.T) {
+	for _, sparse := range []bool{false, true} {
+		sourcePath := source(t, sparse)
+		a, b := t.TempDir(), t.TempDir()
+		// A destination that is a file cannot hold the copy.
+		failing := filepath.Join(t.TempDir(), "failing")
+		os.WriteFile(failing, nil, 0644)
+
+		copied := map[string]int{}
+		failed := map[string]bool{}
+		for _, event := range copyFiles(sourcePath, a, failing, b) {
+			switch event := event.(type) {
+			case fs.CopyingFile:
+				copied[event.To] += event.Size
+			case fs.FileFailed:
+				failed[event.To] = true
+			}
+		}
+		if !failed[failing] || len(failed) != 1 {
+			t.Errorf("sparse %v: got failures %v", sparse, failed)
+		}
+		want, _ := os.ReadFile(sourcePath)
+		for _, dir := range []string{a, b} {
+			if got, _ := os.ReadFile(filepath.Join(dir, "source")); !bytes.Equal(got, want) {
+				t.Errorf("sparse %v: the copy differs from the source", sparse)
+			}
+			if copied[dir] != benchmarkSize {
+				t.Errorf("sparse %v: got progress %d, want %d", sparse, copied[dir], benchmarkSize)
+			}
+		}
+	}
+}
+
+// recorder collects the events of a sync until it is done.
+type recorder struct {
+	events chan any
+	// sent, if set, is called with each event before it is recorded.
+	sent func(event any)
+}
+
+func newRecorder() *recorder {
+	return &recorder{events: make(chan any, 1024)}
+}
+
+func (r *recorder) Send(event any) {
+	if r.sent != nil {
+		r.sent(event)
+	}
+	r.events <- event
+}
+
+// wait returns the events sent until the sync of archive idx was done.
+func (r *recorder) wait(idx int) []any {
+	var events []any
+	for event := range r.events {
+		events = append(events, event)
+		if synced, ok := event.(fs.Synced); ok && synced.Idx == idx {
+			return events
+		}
+	}
+	return events
+}
+
+func TestCopyKeepsFilesInTheWay(t *testing.T) {
+	origin, copy := t.TempDir(), t.TempDir()
+	for path, content := range map[string]string{
+		filepath.Join(origin, "a"): "new",
+		filepath.Join(origin, "b"): "new",
+		filepath.Join(copy, "a"):   "kept",
+	} {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := newRecorder()
+	New(origin, 0, Options{}, lifecycle.New()).Sync([]any{
+		fs.Copy{Path: "a", ToRoots: []string{copy}},
+		fs.Copy{Path: "b", ToRoots: []string{copy}},
+	}, r)
+
+	failed := 0
+	for _, event := range r.wait(0) {
+		if event, ok := event.(fs.FileFailed); ok {
+			failed++
+			if event.Path != "a" || event.To != copy {
+				t.Errorf("got failure %+v", event)
+			}
+		}
+	}
+	if failed != 1 {
+		t.Errorf("got %d failures, want 1", failed)
+	}
+	for name, want := range map[string]string{"a": "kept", "b": "new"} {
+		if got, _ := os.ReadFile(filepath.Join(copy, name)); string(got) != want {
+			t.Errorf("%s holds %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestSlowDestinationHoldsBackNoOther(t *testing.T) {
+	// The holes of sparse files are read rather than left to the kernel, also within a file system.
+	origin := t.TempDir()
+	fast, slow, other := t.TempDir(), t.TempDir(), t.TempDir()
+	var copies []any
+	for _, name := range []string{"a", "b", "c"} {
+		if err := os.Rename(source(t, true), filepath.Join(origin, name)); err != nil {
+			t.Fatal(err)
+		}
+		copies = append(copies, fs.Copy{Path: name, ToRoots: []string{fast, slow, other}})
+	}
+
+	// The slow destination is stuck on its first chunk until the others are done.
+	r := newRecorder()
+	stuck := make(chan struct{})
+	r.sent = func(event any) {
+		if event, ok := event.(fs.CopyingFile); ok && event.To == slow {
+			<-stuck
+		}
+	}
+	New(origin, 0, Options{}, lifecycle.New()).Sync(copies, r)
+
+	done := map[string]int{}
+	timeout := time.After(10 * time.Second)
+	for done[fast] < len(copies) || done[other] < len(copies) {
+		select {
+		case event := <-r.events:
+			if event, ok := event.(fs.FileCopied); ok {
+				if event.To == slow {
+					t.Fatalf("the slow destination got %q before the others were done", event.Path)
+				}
+				done[event.To]++
+			}
+		case <-timeout:
+			close(stuck)
+			t.Fatalf("the slow destination held back the others: got %v", done)
+		}
+	}
+	close(stuck)
+	for _, event := range r.wait(0) {
+		if event, ok := event.(fs.FileFailed); ok {
+			t.Errorf("got failure %+v", event)
+		}
+	}
+	for _, copy := range copies {
+		path := copy.(fs.Copy).Path
+		want, _ := os.ReadFile(filepath.Join(origin, path))
+		for _, dir := range []string{fast, slow, other} {
+			if got, _ := os.ReadFile(filepath.Join(dir, path)); !bytes.Equal(got, want) {
+				t.Errorf("the copy of %s in %s differs from the source", path, dir)
+			}
+		}
+	}
+}
+
+func benchmarkCopy(b *testing.B, sparse bool, copy func(sourcePath, dir string)) {
+	sourcePath := source(b, sparse)
+	dir := b.TempDir()
+	b.SetBytes(benchmarkSize)
+	b.ResetTimer()
+	for range b.N {
+		copy(sourcePath, dir)
+		os.Remove(filepath.Join(dir, "source"))
+	}
+}
+
+func plainCopyTo(b *testing.B) func(sourcePath, dir string) {
+	return func(sourcePath, dir string) {
+		if err := plainCopy(sourcePath, dir); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func copyFilesTo(sourcePath, dir string) {
+	copyFiles(sourcePath, dir)
+}
+
+func BenchmarkPlainCopy(b *testing.B) {
+	benchmarkCopy(b, false, plainCopyTo(b))
+}
+
+func BenchmarkCopyFiles(b *testing.B) {
+	benchmarkCopy(b, false, copyFilesTo)
+}
+
+func BenchmarkPlainCopySparse(b *testing.B) {
+	benchmarkCopy(b, true, plainCopyTo(b))
+}
+
+func BenchmarkCopyFilesSparse(b *testing.B) {
+	benchmarkCopy(b, true, copyFilesTo)
+}
@@ -0,0 +1,81 @@
+//go:build linux && (amd64 || arm64)
+
+package realfs
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// kernelCopy tells that io.Copy between files within a file system runs in the kernel:
+// (*os.File).ReadFrom uses copy_file_range.
+const kernelCopy = true
+
+// ficlone is the ioctl that shares the blocks of a file with another, as on Btrfs and XFS.
+const ficlone = 0x40049409
+
+const (
+	fadvSequential = 2
+	fadvDontNeed   = 4
+)
+
+// clone makes dst share the blocks of src and tells whether the file system allows it.
+func clone(dst, src *os.File) bool {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	return errno == 0
+}
+
+// adviseSequential lets the kernel read ahead further.
+func adviseSequential(file *os.File) {
+	fadvise(file, fadvSequential)
+}
+
+// adviseDone drops the pages of a file read or written once from the page cache,
+// starting to write back the dirty ones, so that they push out no others.
+func adviseDone(file *os.File) {
+	fadvise(file, fadvDontNeed)
+}
+
+func fadvise(file *os.File, advice int) {
+	_, _, _ = syscall.Syscall6(syscall.SYS_FADVISE64, file.Fd(), 0, 0, uintptr(advice), 0, 0)
+}
+
+// fsIocFiemap is the ioctl that maps the extents of a file to their place on disk.
+const fsIocFiemap = 0xC020660B
+
+type fiemap struct {
+	start         uint64
+	length        uint64
+	flags         uint32
+	mappedExtents uint32
+	extentCount   uint32
+	reserved      uint32
+	extent        fiemapExtent
+}
+
+type fiemapExtent struct {
+	logical    uint64
+	physical   uint64
+	length     uint64
+	reserved64 [2]uint64
+	flags      uint32
+	reserved   [3]uint32
+}
+
+// DiskOffset returns where the first extent of the file at path in the archive at root is stored on disk,
+// and false if the file system does not tell.
+func DiskOffset(root, path string) (int64, bool) {
+	file, err := os.Open(filepath.Join(root, path))
+	if err != nil {
+		return 0, false
+	}
+	defer file.Close()
+	m := fiemap{length: ^uint64(0), extentCount: 1}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), fsIocFiemap, uintptr(unsafe.Pointer(&m)))
+	if errno != 0 || m.mappedExtents == 0 {
+		return 0, false
+	}
+	return int64(m.extent.physical), true
+}
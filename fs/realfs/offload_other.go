@@ -0,0 +1,19 @@
+//go:build !linux || !(amd64 || arm64)
+
+package realfs
+
+import "os"
+
+const kernelCopy = false
+
+func clone(dst, src *os.File) bool {
+	return false
+}
+
+func adviseSequential(file *os.File) {}
+
+func adviseDone(file *os.File) {}
+
+func DiskOffset(root, path string) (int64, bool) {
+	return 0, false
+}
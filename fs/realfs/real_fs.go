@@ -4,7 +4,6 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/csv"
-	"errors"
 	"fmt"
 	"io"
 	iofs "io/fs"
@@ -23,21 +22,70 @@ import (
 )
 
 const hashFileName = ".meta.csv"
+const dirsFileName = ".dirs.csv"
 const bufSize = 256 * 1024
 
+type HashMode int
+
+const (
+	// QuickHash hashes the first and the last 256 KiB of a file.
+	QuickHash HashMode = iota
+	// FullHash hashes the whole file.
+	FullHash
+)
+
+func ParseHashMode(mode string) (HashMode, error) {
+	switch mode {
+	case "quick":
+		return QuickHash, nil
+	case "full":
+		return FullHash, nil
+	}
+	return QuickHash, fmt.Errorf("unknown hash mode %q", mode)
+}
+
+func (mode HashMode) String() string {
+	if mode == FullHash {
+		return "full"
+	}
+	return "quick"
+}
+
+// column heads the hash column of the cache, so hashes made in another mode are never reused.
+func (mode HashMode) column() string {
+	if mode == FullHash {
+		return "FullHash"
+	}
+	return "Hash"
+}
+
+type Options struct {
+	Hash HashMode
+	// Rehash ignores cached hashes and reports files whose content no longer matches them.
+	Rehash bool
+	// Ignore holds glob patterns for files and folders to leave out of the archive.
+	// A pattern without a slash matches names, otherwise it matches archive-relative paths;
+	// a trailing slash restricts it to folders.
+	Ignore []string
+	// ReadOnly leaves the hash caches as they are.
+	ReadOnly bool
+}
+
 type meta struct {
-	inode uint64
-	file  *fs.FileMeta
+	inode  uint64
+	file   *fs.FileMeta
+	cached string
 }
 
 type FS struct {
 	root string
 	idx  int
+	opts Options
 	lc   *lifecycle.Lifecycle
 }
 
-func New(path string, idx int, lc *lifecycle.Lifecycle) *FS {
-	return &FS{root: path, idx: idx, lc: lc}
+func New(path string, idx int, opts Options, lc *lifecycle.Lifecycle) *FS {
+	return &FS{root: path, idx: idx, opts: opts, lc: lc}
 }
 
 func (fsys *FS) Root() string {
@@ -60,29 +108,40 @@ func (fsys *FS) scan(events fs.Events) {
 
 	metaMap := fsys.readMeta()
 	var metaSlice []*meta
+	hashed := fs.ArchiveHashed{Idx: fsys.idx}
 
 	defer func() {
-		_ = fsys.storeMeta(fsys.root, metaSlice)
-		events.Send(fs.ArchiveHashed{Idx: fsys.idx})
+		if !fsys.opts.ReadOnly {
+			_ = fsys.storeMeta(fsys.root, metaSlice)
+			_ = fsys.storeFingerprints(fsys.root, metaSlice)
+		}
+		events.Send(hashed)
 	}()
 
 	osfs := os.DirFS(fsys.root)
 	err := iofs.WalkDir(osfs, ".", func(path string, d iofs.DirEntry, err error) error {
+		if err != nil {
+			log.Printf("Error: failed to scan archive %q: %#v\n", fsys.root, err)
+			fsys.failed(events, path, err)
+			return nil
+		}
 		if d.IsDir() && strings.HasPrefix(d.Name(), "~~~") {
 			return iofs.SkipDir
 		}
-		if fsys.lc.ShoudStop() || !d.Type().IsRegular() || strings.HasPrefix(d.Name(), ".") {
+		if path != "." && fsys.ignored(path, d.IsDir()) {
+			if d.IsDir() {
+				return iofs.SkipDir
+			}
 			return nil
 		}
-
-		if err != nil {
-			log.Printf("Error: failed to scan archive %q: %#v\n", fsys.root, err)
+		if fsys.lc.ShoudStop() || !d.Type().IsRegular() || strings.HasPrefix(d.Name(), ".") {
 			return nil
 		}
 
 		info, err := d.Info()
 		if err != nil {
 			log.Printf("Error: failed to scan archive %q: %#v\n", fsys.root, err)
+			fsys.failed(events, path, err)
 			return nil
 		}
 
@@ -101,16 +160,21 @@ func (fsys *FS) scan(events fs.Events) {
 		}
 
 		sys := info.Sys().(*syscall.Stat_t)
+		cached := ""
 		readMeta := metaMap[sys.Ino]
 		if readMeta != nil && readMeta.ModTime == modTime && readMeta.Size == size {
-			file.Hash = readMeta.Hash
+			cached = readMeta.Hash
+			if !fsys.opts.Rehash {
+				file.Hash = cached
+			}
 		}
 
 		metas.Metas = append(metas.Metas, *file)
 
 		metaSlice = append(metaSlice, &meta{
-			inode: sys.Ino,
-			file:  file,
+			inode:  sys.Ino,
+			file:   file,
+			cached: cached,
 		})
 		metaMap[sys.Ino] = file
 
@@ -132,27 +196,46 @@ func (fsys *FS) scan(events fs.Events) {
 			return
 		}
 		log.Printf("%d: hash %q\n", fsys.idx, meta.file.Path)
-		meta.file.Hash = fsys.hashFile(meta.file)
+		start := time.Now()
+		meta.file.Hash, err = fsys.hashFile(meta.file)
+		if err != nil {
+			fsys.failed(events, meta.file.Path, err)
+		} else {
+			hashed.Reading += time.Since(start)
+			hashed.Read += fsys.hashedSize(meta.file.Size)
+		}
 		events.Send(fs.FileHashed{
 			Idx:  fsys.idx,
 			Path: meta.file.Path,
 			Hash: meta.file.Hash,
 		})
+		if meta.cached != "" && meta.file.Hash != "" && meta.file.Hash != meta.cached {
+			log.Printf("Error: file %q in archive %q does not match its cached hash\n", meta.file.Path, fsys.root)
+			events.Send(fs.FileCorrupted{
+				Idx:  fsys.idx,
+				Path: meta.file.Path,
+			})
+			// Keep the cached hash so that the file is reported again until it is replaced.
+			meta.file.Hash = meta.cached
+		}
 	}
 }
 
 func (fsys *FS) sync(commands []any, events fs.Events) {
 	defer events.Send(fs.Synced{Idx: fsys.idx})
+	var copies []fs.Copy
 	for _, cmd := range commands {
 		switch cmd := cmd.(type) {
 		case fs.Rename:
 			log.Printf("rename %q to %q\n", cmd.SourcePath, cmd.DestinationPath)
 			fsys.renameFile(cmd, events)
 		case fs.Copy:
-			log.Printf("copy %q to %v\n", cmd.Path, cmd.ToRoots)
-			fsys.copyFile(cmd, events)
+			copies = append(copies, cmd)
 		}
 	}
+	if len(copies) > 0 {
+		fsys.copyFiles(copies, events)
+	}
 }
 
 func (fsys *FS) renameFile(cmd fs.Rename, events fs.Events) {
@@ -164,6 +247,7 @@ func (fsys *FS) renameFile(cmd fs.Rename, events fs.Events) {
 	err := os.MkdirAll(path, 0755)
 	if err != nil {
 		log.Printf("Error: failed to create folder %q: %#v\n", path, err)
+		fsys.failed(events, cmd.SourcePath, err)
 		return
 	}
 	from := filepath.Join(fsys.root, cmd.SourcePath)
@@ -171,119 +255,51 @@ func (fsys *FS) renameFile(cmd fs.Rename, events fs.Events) {
 	err = os.Rename(from, to)
 	if err != nil {
 		log.Printf("Error: failed to rename file %q: %#v\n", from, err)
+		fsys.failed(events, cmd.SourcePath, err)
 		return
 	}
+	events.Send(fs.FileRenamed{Idx: fsys.idx, Path: cmd.SourcePath})
 	fsys.removeDirIfEmpty(filepath.Dir(from))
 }
 
-func (fsys *FS) copyFile(cmd fs.Copy, events fs.Events) {
-	fsys.lc.Started()
-	defer fsys.lc.Done()
-
-	eventChans := make([]chan []byte, len(cmd.ToRoots))
-
-	defer func() {
-		for _, ch := range eventChans {
-			close(ch)
-		}
-	}()
-
-	source := filepath.Join(fsys.root, cmd.Path)
-	info, err := os.Stat(source)
+// finishCopy closes a file copied to root, or removes it if copying failed, and records its hash.
+func (fsys *FS) finishCopy(cmd fs.Copy, root string, file *os.File, info os.FileInfo, err error, events fs.Events) {
+	fullPath := file.Name()
 	if err != nil {
-		log.Printf("Error: failed to read from file %q: %#v\n", source, err)
+		log.Printf("Error: failed to copy %q to %q: %#v\n", cmd.Path, fullPath, err)
+		fsys.copyFailed(events, root, cmd.Path, err)
+		_ = file.Close()
+		os.Remove(fullPath)
 		return
 	}
-
-	for i, root := range cmd.ToRoots {
-		eventChans[i] = make(chan []byte, 1)
-		go fsys.writer(root, cmd.Path, cmd.Hash, info.Size(), info.ModTime(), eventChans[i])
-	}
-
-	sourceFile, err := os.Open(source)
-	if err != nil {
-		log.Printf("Error: failed to read from file %q: %#v\n", source, err)
+	adviseDone(file)
+
+	written, _ := file.Stat()
+	sys := written.Sys().(*syscall.Stat_t)
+	_ = file.Close()
+	_ = os.Chtimes(fullPath, time.Now(), info.ModTime())
+	if written.Size() != info.Size() {
+		err = fmt.Errorf("copied file %q has size %d, expected %d", fullPath, written.Size(), info.Size())
+		log.Printf("Error: %v\n", err)
+		fsys.copyFailed(events, root, cmd.Path, err)
+		os.Remove(fullPath)
 		return
 	}
+	events.Send(fs.FileCopied{Idx: fsys.idx, To: root, Path: cmd.Path, Size: int(info.Size())})
 
-	defer sourceFile.Close()
-
-	var n int
-	for err != io.EOF && !fsys.lc.ShoudStop() {
-		buf := make([]byte, bufSize)
-		n, err = sourceFile.Read(buf)
-		if err != nil && err != io.EOF {
-			log.Printf("Error: failed to read from file %q: %#v\n", source, err)
-			return
-		}
-		for _, eventChan := range eventChans {
-			eventChan <- buf[:n]
-		}
-		events.Send(fs.CopyingFile{
-			Idx:  fsys.idx,
-			Path: cmd.Path,
-			Size: n,
+	absHashFileName := filepath.Join(root, hashFileName)
+	hashInfoFile, err := os.OpenFile(absHashFileName, os.O_APPEND|os.O_WRONLY, 0644)
+	if err == nil {
+		csvWriter := csv.NewWriter(hashInfoFile)
+		_ = csvWriter.Write([]string{
+			fmt.Sprint(sys.Ino),
+			norm.NFC.String(cmd.Path),
+			fmt.Sprint(info.Size()),
+			info.ModTime().UTC().Format(time.RFC3339Nano),
+			cmd.Hash,
 		})
-	}
-}
-
-func (fsys *FS) writer(root, path, hash string, size int64, modTime time.Time, events chan []byte) {
-	fsys.lc.Started()
-	defer fsys.lc.Done()
-
-	fullPath := filepath.Join(root, path)
-
-	dirPath := filepath.Dir(fullPath)
-	_ = os.MkdirAll(dirPath, 0755)
-	file, createErr := os.Create(fullPath)
-	if createErr != nil {
-		log.Printf("Error: failed to create file %q: %#v\n", fullPath, createErr)
-		return
-	}
-	var err error
-	defer func() {
-		if err != nil {
-			os.Remove(fullPath)
-			return
-		}
-
-		if file != nil {
-			info, _ := file.Stat()
-			sys := info.Sys().(*syscall.Stat_t)
-			newSize := info.Size()
-			_ = file.Close()
-			_ = os.Chtimes(fullPath, time.Now(), modTime)
-
-			if newSize != size {
-				os.Remove(fullPath)
-			}
-
-			absHashFileName := filepath.Join(root, hashFileName)
-			hashInfoFile, err := os.OpenFile(absHashFileName, os.O_APPEND|os.O_WRONLY, 0644)
-			if err == nil {
-				csvWriter := csv.NewWriter(hashInfoFile)
-				_ = csvWriter.Write([]string{
-					fmt.Sprint(sys.Ino),
-					norm.NFC.String(path),
-					fmt.Sprint(size),
-					modTime.UTC().Format(time.RFC3339Nano),
-					hash,
-				})
-				csvWriter.Flush()
-				_ = hashInfoFile.Close()
-			}
-		}
-	}()
-	for buf := range events {
-		n, writeErr := file.Write(buf)
-		if writeErr != nil {
-			err = writeErr
-			return
-		}
-		if n < len(buf) {
-			err = errors.New("short write")
-			return
-		}
+		csvWriter.Flush()
+		_ = hashInfoFile.Close()
 	}
 }
 
@@ -309,7 +325,7 @@ func (fsys *FS) readMeta() map[uint64]*fs.FileMeta {
 	defer hashInfoFile.Close()
 
 	records, err := csv.NewReader(hashInfoFile).ReadAll()
-	if err != nil || len(records) == 0 {
+	if err != nil || len(records) == 0 || len(records[0]) != 5 || records[0][4] != fsys.opts.Hash.column() {
 		return metas
 	}
 
@@ -343,7 +359,7 @@ func (fsys *FS) readMeta() map[uint64]*fs.FileMeta {
 
 func (s *FS) storeMeta(root string, metas []*meta) error {
 	result := make([][]string, 1, len(metas)+1)
-	result[0] = []string{"INode", "Name", "Size", "ModTime", "Hash"}
+	result[0] = []string{"INode", "Name", "Size", "ModTime", s.opts.Hash.column()}
 
 	for _, meta := range metas {
 		if meta.file.Hash == "" {
@@ -369,38 +385,116 @@ func (s *FS) storeMeta(root string, metas []*meta) error {
 	return err
 }
 
-func (fsys *FS) hashFile(meta *fs.FileMeta) string {
+func (s *FS) storeFingerprints(root string, metas []*meta) error {
+	files := make([]fs.FileMeta, 0, len(metas))
+	for _, meta := range metas {
+		files = append(files, *meta.file)
+	}
+	fingerprints := fs.Fingerprints(files)
+
+	result := make([][]string, 1, len(fingerprints)+1)
+	result[0] = []string{"Path", "Size", "Files", "Fingerprint"}
+	for _, path := range fs.DirPaths(fingerprints) {
+		fp := fingerprints[path]
+		result = append(result, []string{
+			norm.NFC.String(path),
+			fmt.Sprint(fp.Size),
+			fmt.Sprint(fp.Files),
+			fp.Hash,
+		})
+	}
+
+	absDirsFileName := filepath.Join(root, dirsFileName)
+	dirsFile, err := os.Create(absDirsFileName)
+	if err != nil {
+		return err
+	}
+	err = csv.NewWriter(dirsFile).WriteAll(result)
+	_ = dirsFile.Close()
+	return err
+}
+
+func (fsys *FS) hashFile(meta *fs.FileMeta) (string, error) {
 	hash := sha256.New()
-	buf := make([]byte, bufSize)
+	pooled := buffers.Get().(*[]byte)
+	defer buffers.Put(pooled)
+	buf := *pooled
 	path := filepath.Join(fsys.root, meta.Path)
 
 	file, err := os.Open(path)
 	if err != nil {
 		log.Printf("Error: failed to scan archive %q: %#v\n", fsys.root, err)
-		return ""
+		return "", err
 	}
 	defer file.Close()
+	// Leave the page cache to files that are read again.
+	adviseSequential(file)
+	defer adviseDone(file)
+
+	if fsys.opts.Hash == FullHash {
+		_, err := io.CopyBuffer(hash, file, buf)
+		if err != nil {
+			log.Printf("Error: failed to scan archive %q: %#v\n", fsys.root, err)
+			return "", err
+		}
+		return base64.RawURLEncoding.EncodeToString(hash.Sum(nil)), nil
+	}
 
 	offset := bufSize
 	if meta.Size > 2*bufSize {
 		offset = meta.Size - bufSize
 	}
-	nr, er := file.Read(buf)
-	if er != nil && er != io.EOF {
+	nr, err := file.Read(buf)
+	if err != nil && err != io.EOF {
 		log.Printf("Error: failed to scan archive %q: %#v\n", fsys.root, err)
-		return ""
+		return "", err
 	}
 	hash.Write(buf[0:nr])
 	if meta.Size > bufSize {
-		nr, er := file.ReadAt(buf, int64(offset))
-		if er != nil && er != io.EOF {
+		nr, err := file.ReadAt(buf, int64(offset))
+		if err != nil && err != io.EOF {
 			log.Printf("Error: failed to scan archive %q: %#v\n", fsys.root, err)
-			return ""
+			return "", err
 		}
 		hash.Write(buf[0:nr])
 	}
 
-	return base64.RawURLEncoding.EncodeToString(hash.Sum(nil))
+	return base64.RawURLEncoding.EncodeToString(hash.Sum(nil)), nil
+}
+
+// hashedSize returns how much of a file of the given size hashFile reads.
+func (fsys *FS) hashedSize(size int) int {
+	if fsys.opts.Hash == FullHash {
+		return size
+	}
+	return min(size, 2*bufSize)
+}
+
+func (fsys *FS) ignored(path string, isDir bool) bool {
+	for _, pattern := range fsys.opts.Ignore {
+		if fs.Match(pattern, path, isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+func (fsys *FS) failed(events fs.Events, path string, err error) {
+	events.Send(fs.FileFailed{
+		Idx:   fsys.idx,
+		Path:  path,
+		Error: err.Error(),
+	})
+}
+
+// copyFailed reports a file that could not be copied to the destination root.
+func (fsys *FS) copyFailed(events fs.Events, root, path string, err error) {
+	events.Send(fs.FileFailed{
+		Idx:   fsys.idx,
+		To:    root,
+		Path:  path,
+		Error: err.Error(),
+	})
 }
 
 func AbsPath(path string) (string, error) {
@@ -0,0 +1,131 @@
+package realfs
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"golang.org/x/text/unicode/norm"
+
+	"dup/fs"
+)
+
+// baseFileName holds the files the archives of a bidirectional sync agreed on after it.
+const baseFileName = ".base.csv"
+
+// historyFileName holds the content the origin had whenever it was synced with the archive.
+const historyFileName = ".history.csv"
+
+// ReadBase returns the files stored by StoreBase in the archive at root.
+// It returns false when there are none, or when they were hashed in another mode.
+func ReadBase(root string, mode HashMode) ([]fs.FileMeta, bool) {
+	file, err := os.Open(filepath.Join(root, baseFileName))
+	if err != nil {
+		return nil, false
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		log.Printf("Error: failed to read the base of %q: %v\n", root, err)
+		return nil, false
+	}
+	if len(records) == 0 || len(records[0]) != 4 || records[0][3] != mode.column() {
+		return nil, false
+	}
+	files := make([]fs.FileMeta, 0, len(records)-1)
+	for _, record := range records[1:] {
+		if len(record) != 4 {
+			return nil, false
+		}
+		size, er1 := strconv.Atoi(record[1])
+		modTime, er2 := time.Parse(time.RFC3339Nano, record[2])
+		if er1 != nil || er2 != nil || record[3] == "" {
+			return nil, false
+		}
+		files = append(files, fs.FileMeta{Path: record[0], Size: size, ModTime: modTime, Hash: record[3]})
+	}
+	return files, true
+}
+
+// StoreBase stores the files the archive at root agrees on with the other archives.
+func StoreBase(root string, mode HashMode, files []fs.FileMeta) error {
+	result := make([][]string, 1, len(files)+1)
+	result[0] = []string{"Name", "Size", "ModTime", mode.column()}
+	for _, file := range files {
+		result = append(result, []string{
+			norm.NFC.String(file.Path),
+			fmt.Sprint(file.Size),
+			file.ModTime.UTC().Format(time.RFC3339Nano),
+			file.Hash,
+		})
+	}
+
+	return writeCSV(filepath.Join(root, baseFileName), result)
+}
+
+// ReadHistory returns the content hashes stored by StoreHistory in the archive at root.
+// It returns false when there are none, or when they were hashed in another mode.
+func ReadHistory(root string, mode HashMode) (map[string]bool, bool) {
+	file, err := os.Open(filepath.Join(root, historyFileName))
+	if err != nil {
+		return nil, false
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		log.Printf("Error: failed to read the history of %q: %v\n", root, err)
+		return nil, false
+	}
+	if len(records) == 0 || len(records[0]) != 1 || records[0][0] != mode.column() {
+		return nil, false
+	}
+	hashes := map[string]bool{}
+	for _, record := range records[1:] {
+		if len(record) == 1 && record[0] != "" {
+			hashes[record[0]] = true
+		}
+	}
+	return hashes, true
+}
+
+// StoreHistory adds content hashes to the history of the archive at root.
+func StoreHistory(root string, mode HashMode, hashes []string) error {
+	history, _ := ReadHistory(root, mode)
+	if history == nil {
+		history = map[string]bool{}
+	}
+	for _, hash := range hashes {
+		history[hash] = true
+	}
+	result := [][]string{{mode.column()}}
+	for _, hash := range slices.Sorted(maps.Keys(history)) {
+		result = append(result, []string{hash})
+	}
+	return writeCSV(filepath.Join(root, historyFileName), result)
+}
+
+// writeCSV replaces the file at path, so that readers never see it half written.
+func writeCSV(path string, records [][]string) error {
+	temp := path + ".tmp"
+	file, err := os.Create(temp)
+	if err != nil {
+		return err
+	}
+	err = csv.NewWriter(file).WriteAll(records)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return os.Rename(temp, path)
+}
@@ -0,0 +1,209 @@
+// Package guard stops a sync that would change a suspicious share of the copies,
+// as when the archives are given in the wrong order or the origin was wiped or encrypted.
+package guard
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+
+	"dup/plan"
+)
+
+// Limits are the changes a sync may make without confirmation; 0 turns a check off.
+type Limits struct {
+	// SetAside is the share of the files of a copy, in percent, that may be backed up or set aside as conflicts.
+	SetAside int
+	// Conflicts is the number of files that may differ between the origin and a copy.
+	Conflicts int
+	// Encrypted is the share of the files set aside in a copy, in percent, that may be replaced
+	// by a version that looks encrypted while the old one does not, and the share of the files
+	// the origin copies to the copies that may look encrypted.
+	Encrypted int
+}
+
+var DefaultLimits = Limits{SetAside: 5, Conflicts: 100, Encrypted: 20}
+
+// The shares are only checked for copies with at least minFiles files concerned,
+// so that small archives can change freely.
+const minFiles = 10
+
+// At most maxSampled of the files the origin copies are read to estimate how many look encrypted.
+const maxSampled = 1000
+
+// A sample of a file with more bits of entropy per byte than encryptedEntropy looks encrypted
+// or compressed; one with less than plainEntropy does not. The entropy is measured past the
+// first headerSize bytes, which are often plain even in compressed files.
+const (
+	sampleSize       = 64 * 1024
+	headerSize       = 4 * 1024
+	encryptedEntropy = 7.5
+	plainEntropy     = 7.0
+)
+
+// signatures are the magic numbers that start files of common formats, by the offset they are found at.
+// Encrypting a file destroys its signature, while compressed formats keep theirs.
+var signatures = []struct {
+	offset int
+	magic  string
+}{
+	{0, "\xff\xd8\xff"},                     // JPEG
+	{0, "\x89PNG\r\n\x1a\n"},                // PNG
+	{0, "GIF8"},                             // GIF
+	{0, "II*\x00"},                          // TIFF and raw photos, little-endian
+	{0, "MM\x00*"},                          // TIFF and raw photos, big-endian
+	{0, "RIFF"},                             // WebP, WAV and AVI
+	{4, "ftyp"},                             // MP4, MOV, HEIC and M4A
+	{0, "\x1aE\xdf\xa3"},                    // Matroska and WebM
+	{0, "ID3"},                              // MP3
+	{0, "\xff\xfb"},                         // MP3 without tags
+	{0, "\xff\xf3"},                         // MP3 without tags
+	{0, "\xff\xf1"},                         // AAC
+	{0, "fLaC"},                             // FLAC
+	{0, "OggS"},                             // Ogg
+	{0, "%PDF-"},                            // PDF
+	{0, "PK\x03\x04"},                       // ZIP, office documents and JAR
+	{0, "\x1f\x8b"},                         // gzip
+	{0, "BZh"},                              // bzip2
+	{0, "\xfd7zXZ\x00"},                     // xz
+	{0, "(\xb5/\xfd"},                       // zstd
+	{0, "7z\xbc\xaf'\x1c"},                  // 7-Zip
+	{0, "Rar!\x1a\x07"},                     // RAR
+	{0, "SQLite format 3\x00"},              // SQLite
+	{0, "\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1"}, // old office documents
+}
+
+// Trip is a limit a plan exceeds.
+type Trip struct {
+	Root   string
+	Reason string
+}
+
+func (t Trip) String() string {
+	return fmt.Sprintf("%s: %s", t.Root, t.Reason)
+}
+
+// Check returns the limits the plan exceeds. It reads samples of the files a copy sets aside
+// and of the origin files that replace them to tell whether they were encrypted, and of the
+// files the origin copies, which are new or changed whatever their path, as when encrypting
+// renamed them.
+func Check(p *plan.Plan, limits Limits) []Trip {
+	var trips []Trip
+	origin := p.Archives[0].Root
+	if limits.Conflicts > 0 && len(p.Decisions) > limits.Conflicts {
+		trips = append(trips, Trip{origin, fmt.Sprintf("%d files differ between the origin and a copy, more than %d", len(p.Decisions), limits.Conflicts)})
+	}
+	if copies := p.Archives[0].Copies; limits.Encrypted > 0 && len(copies) >= minFiles {
+		// Spread the samples over all files.
+		step := max(len(copies)/maxSampled, 1)
+		sampled, encrypted := 0, 0
+		for i := 0; i < len(copies); i += step {
+			sampled++
+			if looksEncrypted(filepath.Join(origin, copies[i].Path)) {
+				encrypted++
+			}
+		}
+		if encrypted >= minFiles && encrypted*100 > limits.Encrypted*sampled {
+			trips = append(trips, Trip{origin, fmt.Sprintf("%d of %d new or changed files look encrypted, more than %d%%", encrypted, sampled, limits.Encrypted)})
+		}
+	}
+	for i, archive := range p.Archives {
+		// files is 0 when some file of the archive could not be hashed, and the share unknown.
+		files := p.Fingerprints[i].Files
+		setAside, encrypted := 0, 0
+		for _, rename := range archive.Renames {
+			if rename.Action != plan.Backup && rename.Action != plan.Conflict {
+				continue
+			}
+			setAside++
+			// The origin file at the path of a file set aside replaces it.
+			if limits.Encrypted > 0 && i > 0 && encryptedFrom(filepath.Join(archive.Root, rename.SourcePath), filepath.Join(origin, rename.SourcePath)) {
+				encrypted++
+			}
+		}
+
+		if limits.SetAside > 0 && files > 0 && setAside >= minFiles && setAside*100 > limits.SetAside*files {
+			trips = append(trips, Trip{archive.Root, fmt.Sprintf("%d of %d files would be set aside, more than %d%%", setAside, files, limits.SetAside)})
+		}
+		if limits.Encrypted > 0 && encrypted >= minFiles && encrypted*100 > limits.Encrypted*setAside {
+			trips = append(trips, Trip{archive.Root, fmt.Sprintf("%d of %d files would be replaced by versions that look encrypted, more than %d%%", encrypted, setAside, limits.Encrypted)})
+		}
+	}
+	return trips
+}
+
+// encryptedFrom tells whether the new version of a file looks encrypted while the old one does not:
+// it looks random and lost the signature of the format of the old one or, for formats without
+// a known signature, the old one looks plain.
+func encryptedFrom(oldPath, newPath string) bool {
+	newSample, err := sample(newPath)
+	if err != nil {
+		return false
+	}
+	oldSample, err := sample(oldPath)
+	if err != nil {
+		return false
+	}
+	if entropy(newSample) < encryptedEntropy {
+		return false
+	}
+	if signed(oldSample) {
+		return !signed(newSample)
+	}
+	return entropy(oldSample) < plainEntropy
+}
+
+// looksEncrypted tells whether the file looks random and starts with no known signature.
+func looksEncrypted(path string) bool {
+	sample, err := sample(path)
+	return err == nil && entropy(sample) >= encryptedEntropy && !signed(sample)
+}
+
+// sample returns the start of the file.
+func sample(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	buf := make([]byte, headerSize+sampleSize)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// signed tells whether the sample starts with a known signature.
+func signed(sample []byte) bool {
+	for _, signature := range signatures {
+		if bytes.HasPrefix(sample[min(signature.offset, len(sample)):], []byte(signature.magic)) {
+			return true
+		}
+	}
+	return false
+}
+
+// entropy returns the Shannon entropy of the sample past its header in bits per byte;
+// samples too short to have more than a header are measured whole.
+func entropy(sample []byte) float64 {
+	if len(sample) > 2*headerSize {
+		sample = sample[headerSize:]
+	}
+	counts := [256]int{}
+	for _, b := range sample {
+		counts[b]++
+	}
+	result := 0.0
+	for _, count := range counts {
+		if count > 0 {
+			p := float64(count) / float64(len(sample))
+			result -= p * math.Log2(p)
+		}
+	}
+	return result
+}
@@ -0,0 +1,120 @@
+package guard
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"dup/fs"
+	"dup/plan"
+)
+
+func plain() []byte {
+	return []byte(strings.Repeat("plain text ", 1000))
+}
+
+func random() []byte {
+	content := make([]byte, 16*1024)
+	rand.Read(content)
+	return content
+}
+
+// compressed looks random past the signature of a JPEG.
+func compressed() []byte {
+	return append([]byte("\xff\xd8\xff\xe0"), random()...)
+}
+
+// setAside returns a plan that backs up n of the files of the copy, whose versions hold the old
+// content in the copy and the new content in the origin.
+func setAside(t *testing.T, n, files int, old, new func() []byte) *plan.Plan {
+	origin, copy := t.TempDir(), t.TempDir()
+	p := &plan.Plan{
+		Archives:     []plan.Archive{{Root: origin}, {Root: copy}},
+		Fingerprints: []fs.Fingerprint{{Files: files}, {Files: files}},
+	}
+	for i := range n {
+		name := fmt.Sprintf("f%d", i)
+		if err := os.WriteFile(filepath.Join(copy, name), old(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(origin, name), new(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		p.Archives[1].Renames = append(p.Archives[1].Renames, plan.Rename{
+			Rename: fs.Rename{SourcePath: name, DestinationPath: "backup/" + name},
+			Action: plan.Backup,
+		})
+	}
+	return p
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		n, files int
+		old, new func() []byte
+		trips    int
+	}{
+		{"few files", 9, 10, plain, random, 0},
+		{"small share", 10, 1000, plain, plain, 0},
+		{"large share", 20, 100, plain, plain, 1},
+		{"encrypted", 20, 100, plain, random, 2},
+		{"signature lost", 20, 100, compressed, random, 2},
+		{"compressed again", 20, 100, compressed, compressed, 1},
+		{"unknown share", 20, 0, plain, plain, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			trips := Check(setAside(t, test.n, test.files, test.old, test.new), DefaultLimits)
+			if len(trips) != test.trips {
+				t.Errorf("got trips %v, want %d", trips, test.trips)
+			}
+			if trips := Check(setAside(t, test.n, test.files, test.old, test.new), Limits{}); len(trips) > 0 {
+				t.Errorf("got trips %v without limits", trips)
+			}
+		})
+	}
+}
+
+// copied returns a plan that copies n new files of the origin, written with the content, to the copy.
+func copied(t *testing.T, n int, content func() []byte) *plan.Plan {
+	origin := t.TempDir()
+	p := &plan.Plan{
+		Archives:     []plan.Archive{{Root: origin}, {Root: t.TempDir()}},
+		Fingerprints: []fs.Fingerprint{{Files: n}, {}},
+	}
+	for i := range n {
+		name := fmt.Sprintf("f%d.locked", i)
+		if err := os.WriteFile(filepath.Join(origin, name), content(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		p.Archives[0].Copies = append(p.Archives[0].Copies, plan.Copy{
+			Copy: fs.Copy{Path: name, ToRoots: []string{p.Archives[1].Root}},
+		})
+	}
+	return p
+}
+
+func TestCheckNewFiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		n       int
+		content func() []byte
+		trips   int
+	}{
+		{"few files", 9, random, 0},
+		{"plain", 20, plain, 0},
+		{"compressed", 20, compressed, 0},
+		{"encrypted", 20, random, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if trips := Check(copied(t, test.n, test.content), DefaultLimits); len(trips) != test.trips {
+				t.Errorf("got trips %v, want %d", trips, test.trips)
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package headless
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"dup/bus"
+	"dup/engine"
+	"dup/fs"
+	"dup/lifecycle"
+	"dup/plan"
+)
+
+const progressInterval = 10 * time.Second
+
+type Options struct {
+	// Quiet suppresses progress lines; failures and the summary are still printed.
+	Quiet bool
+	// Progress receives progress lines and failures.
+	Progress io.Writer
+	// Sinks receive all events in addition to the progress lines.
+	Sinks []bus.Sink
+	// Plan makes the plan to execute once the archives are scanned; nil skips the execution.
+	// By default the engine makes the plan.
+	Plan func(e *engine.Engine) *plan.Plan
+}
+
+// Summary tells what a sync did: Renamed, Copied and CopiedSize count the renames and copies
+// done, not the ones planned.
+type Summary struct {
+	Plan        *plan.Plan
+	Renamed     int
+	Copied      int
+	CopiedSize  int
+	Failed      int
+	Interrupted bool
+	// Err tells why the plan could not be executed.
+	Err error
+	// Fingerprints are the root fingerprints of the archives after the sync.
+	Fingerprints []fs.Fingerprint
+}
+
+// Run syncs the archives without a user interface, the same way app.Run does.
+// An interrupt stops the sync.
+func Run(fss []fs.FS, lc *lifecycle.Lifecycle, opts Options) Summary {
+	e := engine.New(fss, lc)
+	e.Subscribe(bus.SinkFunc(engine.LogEvent))
+	r := &reporter{out: opts.Progress, quiet: opts.Quiet}
+	e.Subscribe(r)
+	for _, sink := range opts.Sinks {
+		e.Subscribe(sink)
+	}
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+	go func() {
+		select {
+		case <-interrupts:
+			e.Stop()
+		case <-e.Done():
+		}
+	}()
+
+	makePlan := opts.Plan
+	if makePlan == nil {
+		makePlan = func(e *engine.Engine) *plan.Plan {
+			return e.Plan(plan.Options{Backup: engine.BackupName(time.Now())})
+		}
+	}
+
+	summary := Summary{Interrupted: true}
+	if e.Scan() {
+		summary.Interrupted = false
+		summary.Plan = makePlan(e)
+		if summary.Plan != nil {
+			var ok bool
+			ok, summary.Err = e.Execute(summary.Plan)
+			summary.Interrupted = !ok && summary.Err == nil
+			summary.Fingerprints = e.Fingerprints()
+		}
+	}
+	e.Stop()
+
+	// The last progress counts what was done.
+	for _, archive := range r.last.Archives {
+		summary.Failed += archive.Failed
+		summary.Renamed += archive.Renamed
+		summary.Copied += archive.Copied
+		summary.CopiedSize += archive.CopiedSize
+	}
+	return summary
+}
+
+func (s Summary) Print(w io.Writer) {
+	if s.Plan != nil {
+		for _, decision := range s.Plan.Decisions {
+			fmt.Fprintf(w, "conflict  %s\n", decision)
+		}
+		for _, file := range s.Plan.NewFiles {
+			fmt.Fprintf(w, "new       %s\n", file)
+		}
+	}
+	switch {
+	case s.Err != nil:
+		fmt.Fprintf(w, "dup: %v\n", s.Err)
+	case s.Interrupted:
+		fmt.Fprintln(w, "dup: interrupted")
+	case s.Plan == nil:
+		fmt.Fprintln(w, "dup: nothing was changed")
+	default:
+		if !s.Plan.Identical() {
+			fmt.Fprintf(w, "dup: synced %d copies of %s: %d renamed, %d copied (%s), %d failed\n",
+				len(s.Plan.Archives)-1, s.Plan.Archives[0].Root, s.Renamed, s.Copied, fs.FormatSize(s.CopiedSize), s.Failed)
+		}
+		if s.Identical() {
+			fp := s.Fingerprints[0]
+			fmt.Fprintf(w, "dup: all archives are identical: %s (%d files)\n", fp.Hash, fp.Files)
+		}
+	}
+}
+
+// Identical tells whether all archives have the same root fingerprint after the sync.
+func (s Summary) Identical() bool {
+	return len(s.Fingerprints) > 0 && !slices.ContainsFunc(s.Fingerprints, func(fp fs.Fingerprint) bool { return fp != s.Fingerprints[0] })
+}
+
+type reporter struct {
+	out      io.Writer
+	quiet    bool
+	last     engine.Progress
+	started  bool
+	reported time.Time
+}
+
+func (r *reporter) Handle(event any) {
+	switch event := event.(type) {
+	case fs.FileFailed:
+		root := event.To
+		if root == "" && event.Idx < len(r.last.Archives) {
+			root = r.last.Archives[event.Idx].Root
+		}
+		fmt.Fprintf(r.out, "failed    %s: %s\n", filepath.Join(root, event.Path), event.Error)
+
+	case engine.Progress:
+		if !r.quiet {
+			r.report(event)
+		}
+		r.last = event
+		r.started = true
+	}
+}
+
+func (r *reporter) report(progress engine.Progress) {
+	changed := false
+	for i, archive := range progress.Archives {
+		if r.started && archive.State == r.last.Archives[i].State {
+			continue
+		}
+		changed = true
+		switch archive.State {
+		case engine.ArchiveScanning:
+			r.printf("scanning  %s", archive.Root)
+		case engine.ArchiveHashing:
+			r.printf("hashing   %s (%d files)", archive.Root, archive.Size)
+		case engine.ArchiveHashed:
+			r.printf("hashed    %s", archive.Root)
+		case engine.ArchiveRenaming:
+			r.printf("renaming  %s (%d files)", archive.Root, archive.Size)
+		case engine.ArchiveCopying:
+			r.printf("copying   %s to %s", fs.FormatSize(archive.Size), archive.Root)
+		}
+	}
+	if changed {
+		r.reported = time.Now()
+		return
+	}
+
+	if time.Since(r.reported) < progressInterval {
+		return
+	}
+	r.reported = time.Now()
+	for _, archive := range progress.Archives {
+		switch archive.State {
+		case engine.ArchiveHashing:
+			r.printf("hashing   %3d%% %s", percent(archive.Done, archive.Size), archive.Root)
+		case engine.ArchiveRenaming:
+			r.printf("renaming  %3d%% %s", percent(archive.Done, archive.Size), archive.Root)
+		case engine.ArchiveCopying:
+			r.printf("copying   %3d%% %s of %s to %s, %s", percent(archive.Done, archive.Size),
+				fs.FormatSize(archive.Done), fs.FormatSize(archive.Size), archive.Root, archive.FilePath)
+		}
+	}
+}
+
+func (r *reporter) printf(format string, args ...any) {
+	fmt.Fprintf(r.out, format+"\n", args...)
+}
+
+func percent(done, size int) int {
+	if size == 0 {
+		return 100
+	}
+	return done * 100 / size
+}
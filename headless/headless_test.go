@@ -0,0 +1,105 @@
+package headless
+
+import (
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"dup/engine"
+	"dup/fs"
+	"dup/lifecycle"
+	"dup/plan"
+)
+
+// archive holds its files in memory and fails to rename or copy the paths in failing.
+type archive struct {
+	root    string
+	idx     int
+	files   []fs.FileMeta
+	failing map[string]bool
+}
+
+func (a *archive) Root() string {
+	return a.root
+}
+
+func (a *archive) Scan(events fs.Events) {
+	go func() {
+		events.Send(fs.FileMetas{Idx: a.idx, Metas: a.files})
+		events.Send(fs.ArchiveHashed{Idx: a.idx})
+	}()
+}
+
+func (a *archive) Sync(commands []any, events fs.Events) {
+	go func() {
+		for _, command := range commands {
+			switch cmd := command.(type) {
+			case fs.Rename:
+				events.Send(fs.RenamingFile{Idx: a.idx, Path: cmd.SourcePath})
+				if a.failing[cmd.SourcePath] {
+					events.Send(fs.FileFailed{Idx: a.idx, Path: cmd.SourcePath, Error: "failed"})
+					continue
+				}
+				events.Send(fs.FileRenamed{Idx: a.idx, Path: cmd.SourcePath})
+			case fs.Copy:
+				for _, root := range cmd.ToRoots {
+					if a.failing[cmd.Path] {
+						events.Send(fs.FileFailed{Idx: a.idx, To: root, Path: cmd.Path, Error: "failed"})
+						continue
+					}
+					events.Send(fs.CopyingFile{Idx: a.idx, To: root, Path: cmd.Path, Size: 10})
+					events.Send(fs.FileCopied{Idx: a.idx, To: root, Path: cmd.Path, Size: 10})
+				}
+			}
+		}
+		events.Send(fs.Synced{Idx: a.idx})
+	}()
+}
+
+func file(path, hash string) fs.FileMeta {
+	return fs.FileMeta{Path: path, Size: 10, Hash: hash}
+}
+
+func TestSummaryCountsWhatWasDone(t *testing.T) {
+	origin := &archive{root: "/origin", files: []fs.FileMeta{file("a", "hash-1"), file("b", "hash-2"), file("c", "hash-3")}}
+	copy := &archive{root: "/copy", idx: 1, files: []fs.FileMeta{file("old-a", "hash-1"), file("extra", "hash-4"), file("other", "hash-5")}}
+	origin.failing = map[string]bool{"c": true}
+	copy.failing = map[string]bool{"other": true}
+
+	var planned *plan.Plan
+	summary := Run([]fs.FS{origin, copy}, lifecycle.New(), Options{Quiet: true, Progress: io.Discard, Plan: func(e *engine.Engine) *plan.Plan {
+		planned = e.Plan(plan.Options{Backup: "backup"})
+		return planned
+	}})
+
+	// The plan renames old-a, extra and other, and copies b and c.
+	if len(planned.Archives[1].Renames) != 3 || len(planned.Archives[0].Copies) != 2 {
+		t.Fatalf("unexpected plan %+v", planned.Archives)
+	}
+	if summary.Interrupted || summary.Err != nil {
+		t.Errorf("got interrupted %v, error %v", summary.Interrupted, summary.Err)
+	}
+	if summary.Identical() {
+		t.Errorf("got identical fingerprints %v after failures", summary.Fingerprints)
+	}
+	summary.Fingerprints = nil
+	want := Summary{Plan: planned, Renamed: 2, Copied: 1, CopiedSize: 10, Failed: 2}
+	if !reflect.DeepEqual(summary, want) {
+		t.Errorf("got summary %+v, want %+v", summary, want)
+	}
+}
+
+func TestFingerprintsAreTakenAfterTheSync(t *testing.T) {
+	origin := &archive{root: "/origin", files: []fs.FileMeta{file("a", "hash-1"), file("b", "hash-2")}}
+	copy := &archive{root: "/copy", idx: 1, files: []fs.FileMeta{file("old-a", "hash-1"), file("extra", "hash-4")}}
+
+	summary := Run([]fs.FS{origin, copy}, lifecycle.New(), Options{Quiet: true, Progress: io.Discard, Plan: func(e *engine.Engine) *plan.Plan {
+		return e.Plan(plan.Options{Backup: engine.BackupName(time.Now())})
+	}})
+
+	before := fs.Fingerprints(origin.files)["."]
+	if !summary.Identical() || summary.Fingerprints[0] != before {
+		t.Errorf("got fingerprints %v, want %v for both", summary.Fingerprints, before)
+	}
+}
@@ -0,0 +1,238 @@
+// Package jsonl writes dup events as JSON Lines, one object per line.
+//
+// Every object carries the schema version "v", the "time" it was written at and its "type".
+// Fields are only ever added within a schema version; renaming or removing one bumps it.
+package jsonl
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"dup/bus"
+	"dup/dryrun"
+	"dup/engine"
+	"dup/fs"
+	"dup/plan"
+)
+
+const Version = 1
+
+type header struct {
+	V    int    `json:"v"`
+	Time string `json:"time"`
+	Type string `json:"type"`
+}
+
+type scannedRecord struct {
+	header
+	Archive int    `json:"archive"`
+	Root    string `json:"root"`
+	Files   int    `json:"files"`
+	Bytes   int    `json:"bytes"`
+}
+
+type archiveRecord struct {
+	header
+	Archive int    `json:"archive"`
+	Root    string `json:"root"`
+	To      string `json:"to,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Bytes   int    `json:"bytes,omitempty"`
+	Hash    string `json:"hash,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type droppedRecord struct {
+	header
+	Events int `json:"events"`
+}
+
+type stateRecord struct {
+	header
+	State string `json:"state"`
+}
+
+type planRecord struct {
+	header
+	Identical bool           `json:"identical"`
+	Archives  []planArchive  `json:"archives"`
+	Conflicts []planConflict `json:"conflicts"`
+	NewFiles  []planNewFile  `json:"new_files"`
+}
+
+type planNewFile struct {
+	Root   string `json:"root"`
+	Path   string `json:"path"`
+	Bytes  int    `json:"bytes"`
+	Hash   string `json:"hash"`
+	Pulled bool   `json:"pulled"`
+}
+
+type planConflict struct {
+	Path   string `json:"path"`
+	Policy string `json:"policy"`
+	Winner string `json:"winner,omitempty"`
+}
+
+type planArchive struct {
+	Root    string       `json:"root"`
+	Renames []planRename `json:"renames"`
+	Copies  []planCopy   `json:"copies"`
+}
+
+type planRename struct {
+	Action string `json:"action"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Bytes  int    `json:"bytes"`
+	Hash   string `json:"hash,omitempty"`
+}
+
+type planCopy struct {
+	Path  string   `json:"path"`
+	Hash  string   `json:"hash"`
+	Bytes int      `json:"bytes"`
+	To    []string `json:"to"`
+}
+
+type dryRunRecord struct {
+	header
+	OK       bool             `json:"ok"`
+	Archives []dryrun.Archive `json:"archives"`
+}
+
+type Summary struct {
+	Renamed     int  `json:"renamed"`
+	Copied      int  `json:"copied"`
+	CopiedBytes int  `json:"copied_bytes"`
+	Failed      int  `json:"failed"`
+	Interrupted bool `json:"interrupted"`
+}
+
+type summaryRecord struct {
+	header
+	Summary
+}
+
+// Writer is a bus sink which writes events as JSON Lines.
+type Writer struct {
+	mu    sync.Mutex
+	enc   *json.Encoder
+	roots []string
+	state engine.State
+}
+
+// New returns a writer for the events of the archives at roots.
+func New(w io.Writer, roots []string) *Writer {
+	return &Writer{enc: json.NewEncoder(w), roots: roots, state: -1}
+}
+
+func (w *Writer) Handle(event any) {
+	switch event := event.(type) {
+	case fs.FileMetas:
+		bytes := 0
+		for _, meta := range event.Metas {
+			bytes += meta.Size
+		}
+		w.write(scannedRecord{header: newHeader("scanned"), Archive: event.Idx, Root: w.root(event.Idx), Files: len(event.Metas), Bytes: bytes})
+	case fs.FileHashed:
+		w.write(archiveRecord{header: newHeader("file_hashed"), Archive: event.Idx, Root: w.root(event.Idx), Path: event.Path, Hash: event.Hash})
+	case fs.FileCorrupted:
+		w.write(archiveRecord{header: newHeader("file_corrupted"), Archive: event.Idx, Root: w.root(event.Idx), Path: event.Path})
+	case fs.FileFailed:
+		w.write(archiveRecord{header: newHeader("file_failed"), Archive: event.Idx, Root: w.root(event.Idx), To: event.To, Path: event.Path, Error: event.Error})
+	case fs.ArchiveHashed:
+		w.write(archiveRecord{header: newHeader("archive_hashed"), Archive: event.Idx, Root: w.root(event.Idx)})
+	case fs.RenamingFile:
+		w.write(archiveRecord{header: newHeader("renaming_file"), Archive: event.Idx, Root: w.root(event.Idx), Path: event.Path})
+	case fs.CopyingFile:
+		w.write(archiveRecord{header: newHeader("copying_file"), Archive: event.Idx, Root: w.root(event.Idx), To: event.To, Path: event.Path, Bytes: event.Size})
+	case fs.FileRenamed:
+		w.write(archiveRecord{header: newHeader("file_renamed"), Archive: event.Idx, Root: w.root(event.Idx), Path: event.Path})
+	case fs.FileCopied:
+		w.write(archiveRecord{header: newHeader("file_copied"), Archive: event.Idx, Root: w.root(event.Idx), To: event.To, Path: event.Path, Bytes: event.Size})
+	case fs.Synced:
+		w.write(archiveRecord{header: newHeader("synced"), Archive: event.Idx, Root: w.root(event.Idx)})
+	case bus.Dropped:
+		w.write(droppedRecord{header: newHeader("dropped"), Events: event.Events})
+	case engine.Executing:
+		w.Plan(event.Plan)
+	case engine.Progress:
+		if event.State != w.state {
+			w.state = event.State
+			w.write(stateRecord{header: newHeader("state"), State: event.State.String()})
+		}
+	}
+}
+
+func (w *Writer) Plan(p *plan.Plan) {
+	record := planRecord{header: newHeader("plan"), Identical: p.Identical(), Conflicts: []planConflict{}, NewFiles: []planNewFile{}}
+	for _, archive := range p.Archives {
+		a := planArchive{Root: archive.Root, Renames: []planRename{}, Copies: []planCopy{}}
+		for _, rename := range archive.Renames {
+			a.Renames = append(a.Renames, planRename{
+				Action: rename.Action.String(),
+				From:   rename.SourcePath,
+				To:     rename.DestinationPath,
+				Bytes:  rename.Size,
+				Hash:   rename.Hash,
+			})
+		}
+		for _, copy := range archive.Copies {
+			a.Copies = append(a.Copies, planCopy{
+				Path:  copy.Path,
+				Hash:  copy.Hash,
+				Bytes: copy.Size,
+				To:    copy.ToRoots,
+			})
+		}
+		record.Archives = append(record.Archives, a)
+	}
+	for _, decision := range p.Decisions {
+		record.Conflicts = append(record.Conflicts, planConflict{
+			Path:   decision.Path,
+			Policy: decision.Policy.String(),
+			Winner: decision.Winner,
+		})
+	}
+	for _, file := range p.NewFiles {
+		record.NewFiles = append(record.NewFiles, planNewFile{
+			Root:   file.Root,
+			Path:   file.Path,
+			Bytes:  file.Size,
+			Hash:   file.Hash,
+			Pulled: file.Pulled,
+		})
+	}
+	w.write(record)
+}
+
+// DryRun writes the plan of the report followed by its totals.
+func (w *Writer) DryRun(report dryrun.Report) {
+	w.Plan(report.Plan)
+	w.write(dryRunRecord{header: newHeader("dry_run"), OK: report.OK(), Archives: report.Archives})
+}
+
+func (w *Writer) Summary(summary Summary) {
+	w.write(summaryRecord{header: newHeader("summary"), Summary: summary})
+}
+
+// root returns the root of the archive at idx.
+func (w *Writer) root(idx int) string {
+	if idx < len(w.roots) {
+		return w.roots[idx]
+	}
+	return ""
+}
+
+func (w *Writer) write(record any) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_ = w.enc.Encode(record)
+}
+
+func newHeader(recordType string) header {
+	return header{V: Version, Time: time.Now().UTC().Format(time.RFC3339Nano), Type: recordType}
+}
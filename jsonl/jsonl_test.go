@@ -0,0 +1,84 @@
+package jsonl
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"dup/bus"
+	"dup/engine"
+	"dup/fs"
+	"dup/plan"
+)
+
+// records decodes the lines written by the writer, checking and dropping their version and time.
+func records(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var result []map[string]any
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		record := map[string]any{}
+		if err := dec.Decode(&record); err != nil {
+			t.Fatal(err)
+		}
+		if record["v"] != float64(Version) {
+			t.Errorf("got version %v in %v", record["v"], record)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, record["time"].(string)); err != nil {
+			t.Errorf("got time %v in %v", record["time"], record)
+		}
+		delete(record, "v")
+		delete(record, "time")
+		result = append(result, record)
+	}
+	return result
+}
+
+func TestRecords(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := New(buf, []string{"/origin", "/copy"})
+	w.Handle(engine.Progress{State: engine.Scanning})
+	w.Handle(engine.Progress{State: engine.Scanning})
+	w.Handle(fs.FileMetas{Idx: 1, Metas: []fs.FileMeta{{Path: "a", Size: 3}, {Path: "b", Size: 4}}})
+	w.Handle(fs.FileHashed{Idx: 1, Path: "a", Hash: "hash-1"})
+	w.Handle(fs.FileFailed{Idx: 0, To: "/copy", Path: "b", Error: "failed"})
+	w.Handle(fs.CopyingFile{Idx: 0, To: "/copy", Path: "a", Size: 3})
+	w.Handle(fs.FileCopied{Idx: 0, To: "/copy", Path: "a", Size: 3})
+	w.Handle(bus.Dropped{Events: 5})
+	w.Handle(engine.Executing{Plan: &plan.Plan{
+		Archives: []plan.Archive{
+			{Root: "/origin", Copies: []plan.Copy{{Copy: fs.Copy{Path: "a", Hash: "hash-1", ToRoots: []string{"/copy"}}, Size: 3}}},
+			{Root: "/copy"},
+		},
+		Fingerprints: []fs.Fingerprint{{Hash: "x"}, {Hash: "y"}},
+	}})
+	w.Summary(Summary{Renamed: 1, Copied: 2, CopiedBytes: 3, Failed: 4})
+
+	want := []map[string]any{
+		{"type": "state", "state": "scanning"},
+		{"type": "scanned", "archive": 1.0, "root": "/copy", "files": 2.0, "bytes": 7.0},
+		{"type": "file_hashed", "archive": 1.0, "root": "/copy", "path": "a", "hash": "hash-1"},
+		{"type": "file_failed", "archive": 0.0, "root": "/origin", "to": "/copy", "path": "b", "error": "failed"},
+		{"type": "copying_file", "archive": 0.0, "root": "/origin", "to": "/copy", "path": "a", "bytes": 3.0},
+		{"type": "file_copied", "archive": 0.0, "root": "/origin", "to": "/copy", "path": "a", "bytes": 3.0},
+		{"type": "dropped", "events": 5.0},
+		{"type": "plan", "identical": false, "conflicts": []any{}, "new_files": []any{}, "archives": []any{
+			map[string]any{"root": "/origin", "renames": []any{}, "copies": []any{
+				map[string]any{"path": "a", "hash": "hash-1", "bytes": 3.0, "to": []any{"/copy"}},
+			}},
+			map[string]any{"root": "/copy", "renames": []any{}, "copies": []any{}},
+		}},
+		{"type": "summary", "renamed": 1.0, "copied": 2.0, "copied_bytes": 3.0, "failed": 4.0, "interrupted": false},
+	}
+	got := records(t, buf)
+	if len(got) != len(want) {
+		t.Fatalf("got %d records, want %d: %v", len(got), len(want), got)
+	}
+	for i := range want {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("record %d:\n got  %v\n want %v", i, got[i], want[i])
+		}
+	}
+}
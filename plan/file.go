@@ -0,0 +1,256 @@
+package plan
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+
+	"dup/fs"
+)
+
+// FileVersion is the version of the plan file format.
+const FileVersion = 1
+
+type planFile struct {
+	Version  int           `json:"version"`
+	Archives []archiveFile `json:"archives"`
+}
+
+type archiveFile struct {
+	Root    string       `json:"root"`
+	Renames []renameFile `json:"renames"`
+	Copies  []copyFile   `json:"copies"`
+}
+
+type renameFile struct {
+	Action string `json:"action"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Size   int    `json:"size"`
+	Hash   string `json:"hash"`
+}
+
+type copyFile struct {
+	Path string   `json:"path"`
+	Size int      `json:"size"`
+	Hash string   `json:"hash"`
+	To   []string `json:"to"`
+}
+
+// Write stores the commands of the plan as indented JSON, so that it can be reviewed and edited.
+func (p *Plan) Write(w io.Writer) error {
+	file := planFile{Version: FileVersion}
+	for _, archive := range p.Archives {
+		a := archiveFile{Root: archive.Root, Renames: []renameFile{}, Copies: []copyFile{}}
+		for _, rename := range archive.Renames {
+			a.Renames = append(a.Renames, renameFile{
+				Action: rename.Action.String(),
+				From:   rename.SourcePath,
+				To:     rename.DestinationPath,
+				Size:   rename.Size,
+				Hash:   rename.Hash,
+			})
+		}
+		for _, copy := range archive.Copies {
+			a.Copies = append(a.Copies, copyFile{Path: copy.Path, Size: copy.Size, Hash: copy.Hash, To: copy.ToRoots})
+		}
+		file.Archives = append(file.Archives, a)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(file)
+}
+
+// Read loads a plan stored by Write, with its roots cleaned and in NFC as archives are opened.
+// The plan has no fingerprints until it is validated.
+func Read(r io.Reader) (*Plan, error) {
+	file := planFile{}
+	if err := json.NewDecoder(r).Decode(&file); err != nil {
+		return nil, err
+	}
+	if file.Version != FileVersion {
+		return nil, fmt.Errorf("unsupported plan version %d", file.Version)
+	}
+	if len(file.Archives) < 2 {
+		return nil, fmt.Errorf("a plan needs an origin and at least one copy")
+	}
+
+	roots := []string{}
+	for i, a := range file.Archives {
+		if !filepath.IsAbs(a.Root) {
+			return nil, fmt.Errorf("archive root %q is not absolute", a.Root)
+		}
+		file.Archives[i].Root = cleanRoot(a.Root)
+		roots = append(roots, file.Archives[i].Root)
+	}
+	p := &Plan{}
+	for _, a := range file.Archives {
+		archive := Archive{Root: a.Root}
+		for _, rename := range a.Renames {
+			action, err := parseAction(rename.Action)
+			if err != nil {
+				return nil, err
+			}
+			if !filepath.IsLocal(rename.From) || !filepath.IsLocal(rename.To) {
+				return nil, fmt.Errorf("rename %q -> %q leaves archive %q", rename.From, rename.To, a.Root)
+			}
+			archive.Renames = append(archive.Renames, Rename{
+				Rename: fs.Rename{SourcePath: rename.From, DestinationPath: rename.To},
+				Action: action,
+				Size:   rename.Size,
+				Hash:   rename.Hash,
+			})
+		}
+		for _, copy := range a.Copies {
+			if !filepath.IsLocal(copy.Path) {
+				return nil, fmt.Errorf("copy %q leaves archive %q", copy.Path, a.Root)
+			}
+			for i, root := range copy.To {
+				copy.To[i] = cleanRoot(root)
+				if copy.To[i] == a.Root || !slices.Contains(roots, copy.To[i]) {
+					return nil, fmt.Errorf("copy %q goes to %q, which is not another archive in the plan", copy.Path, root)
+				}
+			}
+			archive.Copies = append(archive.Copies, Copy{
+				Copy: fs.Copy{Path: copy.Path, Hash: copy.Hash, ToRoots: copy.To},
+				Size: copy.Size,
+			})
+		}
+		p.Archives = append(p.Archives, archive)
+	}
+	return p, nil
+}
+
+func cleanRoot(root string) string {
+	return norm.NFC.String(filepath.Clean(root))
+}
+
+func parseAction(action string) (Action, error) {
+	for _, a := range []Action{Move, Backup, Conflict} {
+		if a.String() == action {
+			return a, nil
+		}
+	}
+	return Move, fmt.Errorf("unknown action %q", action)
+}
+
+// Stale describes a plan entry whose precondition no longer holds.
+type Stale struct {
+	Root   string
+	Path   string
+	Reason string
+}
+
+func (s Stale) String() string {
+	return fmt.Sprintf("%s: %s", filepath.Join(s.Root, s.Path), s.Reason)
+}
+
+// pathCounts counts the files at or below every path of an archive.
+type pathCounts map[string]int
+
+func (p pathCounts) add(path string, n int) {
+	for ; path != "." && path != "/"; path = filepath.Dir(path) {
+		p[path] += n
+	}
+}
+
+// Validate checks every entry of the plan against fresh snapshots of its archives, in plan order.
+// It returns the plan without the stale entries, with the fingerprints of the snapshots.
+func Validate(p *Plan, snapshots []Snapshot) (*Plan, []Stale) {
+	result := &Plan{}
+	var stale []Stale
+	archives := []map[string]fs.FileMeta{}
+	fingerprints := []map[string]fs.Fingerprint{}
+	for _, snapshot := range snapshots {
+		files := map[string]fs.FileMeta{}
+		for _, meta := range snapshot.Files {
+			files[meta.Path] = meta
+		}
+		archives = append(archives, files)
+		fps := fs.Fingerprints(snapshot.Files)
+		fingerprints = append(fingerprints, fps)
+		result.Fingerprints = append(result.Fingerprints, fps["."])
+	}
+
+	for i, archive := range p.Archives {
+		files := archives[i]
+		occupied := pathCounts{}
+		for path := range files {
+			occupied.add(path, 1)
+		}
+		valid := Archive{Root: archive.Root}
+		for _, rename := range archive.Renames {
+			// Folders are renamed as a whole and described by their fingerprints.
+			size, hash, ok := 0, "", false
+			if source, isFile := files[rename.SourcePath]; isFile {
+				size, hash, ok = source.Size, source.Hash, true
+			} else if fp, isDir := fingerprints[i][rename.SourcePath]; isDir {
+				size, hash, ok = fp.Size, fp.Hash, true
+			}
+			reason := ""
+			switch {
+			case !ok:
+				reason = "is gone"
+			case size != rename.Size || hash != rename.Hash:
+				reason = "has changed"
+			case occupied[rename.DestinationPath] > 0:
+				reason = fmt.Sprintf("cannot be renamed, %q exists", rename.DestinationPath)
+			}
+			if reason != "" {
+				stale = append(stale, Stale{Root: archive.Root, Path: rename.SourcePath, Reason: reason})
+				continue
+			}
+			move := func(path string, file fs.FileMeta) {
+				delete(files, path)
+				occupied.add(path, -1)
+				file.Path = rename.DestinationPath + strings.TrimPrefix(path, rename.SourcePath)
+				files[file.Path] = file
+				occupied.add(file.Path, 1)
+			}
+			if file, isFile := files[rename.SourcePath]; isFile {
+				move(rename.SourcePath, file)
+			} else {
+				for path, file := range files {
+					if fs.InDir(path, rename.SourcePath) {
+						move(path, file)
+					}
+				}
+			}
+			valid.Renames = append(valid.Renames, rename)
+		}
+		result.Archives = append(result.Archives, valid)
+	}
+
+	for i, archive := range p.Archives {
+		for _, copy := range archive.Copies {
+			source, ok := archives[i][copy.Path]
+			if !ok || source.Size != copy.Size || source.Hash != copy.Hash {
+				reason := "is gone"
+				if ok {
+					reason = "has changed"
+				}
+				stale = append(stale, Stale{Root: archive.Root, Path: copy.Path, Reason: reason})
+				continue
+			}
+			valid := copy
+			valid.ToRoots = nil
+			for _, root := range copy.ToRoots {
+				j := slices.IndexFunc(p.Archives, func(a Archive) bool { return a.Root == root })
+				if _, ok := archives[j][copy.Path]; ok {
+					stale = append(stale, Stale{Root: root, Path: copy.Path, Reason: "already exists"})
+					continue
+				}
+				valid.ToRoots = append(valid.ToRoots, root)
+			}
+			if len(valid.ToRoots) > 0 {
+				result.Archives[i].Copies = append(result.Archives[i].Copies, valid)
+			}
+		}
+	}
+	return result, stale
+}
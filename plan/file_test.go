@@ -0,0 +1,109 @@
+package plan
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"dup/fs"
+)
+
+func TestPlanFileRoundTrip(t *testing.T) {
+	p := Make([]Snapshot{
+		snapshot("/origin", "a", "hash-1", "dir/b", "hash-2"),
+		snapshot("/copy", "old", "hash-1", "extra", "hash-3"),
+	}, Options{Backup: backup})
+
+	buf := bytes.Buffer{}
+	if err := p.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	read, err := Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, "archives", read.Archives, p.Archives)
+}
+
+func TestPlanFileRootsAreCleaned(t *testing.T) {
+	file := `{"version": 1, "archives": [
+		{"root": "/origin/", "copies": [{"path": "a", "to": ["/cafe\u0301/./"]}]},
+		{"root": "/cafe\u0301"}
+	]}`
+	p, err := Read(strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, "roots", []string{p.Archives[0].Root, p.Archives[1].Root}, []string{"/origin", "/caf\u00e9"})
+	check(t, "copy roots", p.Archives[0].Copies[0].ToRoots, []string{"/caf\u00e9"})
+}
+
+func TestPlanFileIsChecked(t *testing.T) {
+	for name, file := range map[string]string{
+		"version":   `{"version": 2, "archives": []}`,
+		"relative":  `{"version": 1, "archives": [{"root": "origin"}, {"root": "/copy"}]}`,
+		"escape":    `{"version": 1, "archives": [{"root": "/origin"}, {"root": "/copy", "renames": [{"action": "move", "from": "a", "to": "../a"}]}]}`,
+		"action":    `{"version": 1, "archives": [{"root": "/origin"}, {"root": "/copy", "renames": [{"action": "delete", "from": "a", "to": "b"}]}]}`,
+		"unknown":   `{"version": 1, "archives": [{"root": "/origin", "copies": [{"path": "a", "to": ["/other"]}]}, {"root": "/copy"}]}`,
+		"one":       `{"version": 1, "archives": [{"root": "/origin"}]}`,
+		"malformed": `{"version": 1, "archives": [`,
+	} {
+		if _, err := Read(strings.NewReader(file)); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestStaleEntriesAreDropped(t *testing.T) {
+	p := Make([]Snapshot{
+		snapshot("/origin", "a", "hash-1", "b", "hash-2", "c", "hash-3"),
+		snapshot("/copy", "old-a", "hash-1", "old-b", "hash-2"),
+	}, Options{Backup: backup})
+
+	valid, stale := Validate(p, []Snapshot{
+		snapshot("/origin", "a", "hash-1", "b", "hash-2", "c", "hash-4"),
+		snapshot("/copy", "old-a", "hash-1", "old-b", "hash-5"),
+	})
+
+	check(t, "renames", renames(valid, 1), []fs.Rename{{SourcePath: "old-a", DestinationPath: "a"}})
+	check(t, "copies", copies(valid, 0), nil)
+	check(t, "stale", stale, []Stale{
+		{Root: "/copy", Path: "old-b", Reason: "has changed"},
+		{Root: "/origin", Path: "c", Reason: "has changed"},
+	})
+}
+
+func TestCopiesIntoOccupiedPathsAreStale(t *testing.T) {
+	p := Make([]Snapshot{
+		snapshot("/origin", "a", "hash-1"),
+		snapshot("/copy 1"),
+		snapshot("/copy 2"),
+	}, Options{Backup: backup})
+
+	valid, stale := Validate(p, []Snapshot{
+		snapshot("/origin", "a", "hash-1"),
+		snapshot("/copy 1", "a", "hash-2"),
+		snapshot("/copy 2"),
+	})
+
+	check(t, "copies", copies(valid, 0), []fs.Copy{{Path: "a", Hash: "hash-1", ToRoots: []string{"/copy 2"}}})
+	check(t, "stale", stale, []Stale{{Root: "/copy 1", Path: "a", Reason: "already exists"}})
+}
+
+func TestMovedFolderIsValidated(t *testing.T) {
+	snapshots := []Snapshot{
+		snapshot("/origin", "new/a", "hash-1", "new/b", "hash-2"),
+		snapshot("/copy", "old/a", "hash-1", "old/b", "hash-2"),
+	}
+	p := Make(snapshots, Options{Backup: backup})
+
+	valid, stale := Validate(p, snapshots)
+	check(t, "renames", renames(valid, 1), []fs.Rename{{SourcePath: "old", DestinationPath: "new"}})
+	check(t, "stale", stale, []Stale(nil))
+
+	_, stale = Validate(p, []Snapshot{
+		snapshots[0],
+		snapshot("/copy", "old/a", "hash-1", "old/b", "hash-3"),
+	})
+	check(t, "changed", stale, []Stale{{Root: "/copy", Path: "old", Reason: "has changed"}})
+}
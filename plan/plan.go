@@ -0,0 +1,1180 @@
+package plan
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"math"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"dup/fs"
+)
+
+type Snapshot struct {
+	Root  string
+	Files []fs.FileMeta
+}
+
+type Options struct {
+	// Backup names the folder excess files are moved into and prefixes the names of conflicting files.
+	Backup string
+	// Resolutions decide paths whose content differs between the origin and a copy, by path.
+	Resolutions map[string]Resolution
+	// Rules decide the paths without a resolution; the first rule matching the path
+	// or one of its folders wins. Policy decides the paths no rule matches.
+	Rules  []Rule
+	Policy Policy
+	// Additive only ever adds files to the copies: nothing in a copy is renamed, set aside or
+	// replaced, files the origin lacks stay, and conflicting files are skipped whatever the policy.
+	Additive bool
+	// Bidirectional treats every archive as an origin: changes made to any archive since Base
+	// spread to the others, and the policies only decide files changed differently in several archives.
+	Bidirectional bool
+	// Base holds the files all archives agreed on after the last bidirectional sync, nil for the first one.
+	Base []fs.FileMeta
+	// Histories hold, by archive, the content the origin had whenever it was synced with the archive;
+	// nil where it is unknown. Files of a copy whose content the origin never had are new in the copy
+	// rather than deleted from the origin.
+	Histories []map[string]bool
+	// PullNew copies the new files of the copies into the origin and the other copies
+	// instead of leaving them where they are.
+	PullNew bool
+	// Speeds hold the read speed of every archive in bytes per second, 0 where it is unknown.
+	// A file is copied from the archive holding it that would be done reading soonest.
+	Speeds []float64
+	// Priorities are patterns, as rules match them, of the files to copy first, in that order.
+	// Order sorts the files alike in priority; Offset tells where a file of an archive starts on disk
+	// for ByDiskOffset, false where it is unknown.
+	Priorities []string
+	Order      Order
+	Offset     func(root, path string) (int64, bool)
+}
+
+// Order is the order in which every archive copies its files.
+type Order int
+
+const (
+	ByPath Order = iota
+	SmallestFirst
+	// ByDiskOffset reads the files in the order they are stored on disk, to cut seeking on
+	// rotational disks; files at unknown offsets come last.
+	ByDiskOffset
+)
+
+var orderNames = map[string]Order{
+	"path":           ByPath,
+	"smallest-first": SmallestFirst,
+	"disk":           ByDiskOffset,
+}
+
+func ParseOrder(name string) (Order, error) {
+	order, ok := orderNames[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown copy order %q", name)
+	}
+	return order, nil
+}
+
+func (o Order) String() string {
+	switch o {
+	case ByPath:
+		return "path"
+	case SmallestFirst:
+		return "smallest-first"
+	case ByDiskOffset:
+		return "disk"
+	}
+	return "unknown"
+}
+
+// Rule applies a policy to the paths matching a pattern, as fs.Match matches them.
+type Rule struct {
+	Pattern string
+	Policy  Policy
+}
+
+// Matches tells whether the pattern matches the file or one of its folders.
+func (r Rule) Matches(path string) bool {
+	return matches(r.Pattern, path)
+}
+
+type Policy int
+
+const (
+	// OriginWins sets the copy's version aside and replaces it with the origin's. In a
+	// bidirectional sync the origin is the first listed archive that changed the file.
+	OriginWins Policy = iota
+	// NewestWins keeps the most recently modified version everywhere.
+	NewestWins
+	// KeepBoth keeps the origin's version and adds every other version under a suffixed name.
+	KeepBoth
+	// CopyWins pulls the version of Resolution.Archive into the origin and every other copy.
+	CopyWins
+	// LargestWins keeps the largest version everywhere.
+	LargestWins
+	// Skip leaves every version where it is; copies that lack the file still receive the origin's.
+	Skip
+)
+
+var policyNames = map[string]Policy{
+	"origin-wins":  OriginWins,
+	"newest-wins":  NewestWins,
+	"keep-both":    KeepBoth,
+	"largest-wins": LargestWins,
+	"skip":         Skip,
+	// Longer names
+	"newest-mtime-wins":     NewestWins,
+	"keep-both-with-suffix": KeepBoth,
+	"skip-and-report":       Skip,
+}
+
+// ParsePolicy returns the policy called name; copy-wins needs an archive and has no name.
+func ParsePolicy(name string) (Policy, error) {
+	policy, ok := policyNames[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown conflict policy %q", name)
+	}
+	return policy, nil
+}
+
+func (p Policy) String() string {
+	switch p {
+	case OriginWins:
+		return "origin-wins"
+	case NewestWins:
+		return "newest-wins"
+	case KeepBoth:
+		return "keep-both"
+	case CopyWins:
+		return "copy-wins"
+	case LargestWins:
+		return "largest-wins"
+	case Skip:
+		return "skip"
+	}
+	return "unknown"
+}
+
+type Resolution struct {
+	Policy Policy
+	// Archive is the index of the archive whose version wins with CopyWins.
+	Archive int
+}
+
+// ConflictingFile is a path whose content differs between the origin and at least one copy.
+type ConflictingFile struct {
+	Path string
+	// Versions hold the file in every archive, nil where it is absent.
+	Versions []*fs.FileMeta
+}
+
+// Decision records how the planner resolved a conflicting file.
+type Decision struct {
+	Path   string
+	Policy Policy
+	// Winner is the root of the archive whose version ends up at Path, empty for skipped files.
+	Winner string
+}
+
+func (d Decision) String() string {
+	switch {
+	case d.Winner == "":
+		return fmt.Sprintf("%s: %s, every version is left where it is", d.Path, d.Policy)
+	case d.Policy == KeepBoth:
+		return fmt.Sprintf("%s: %s, every version is kept", d.Path, d.Policy)
+	}
+	return fmt.Sprintf("%s: %s, the version of %s is kept", d.Path, d.Policy, d.Winner)
+}
+
+// NewFile is a file of a copy whose content the origin never had.
+type NewFile struct {
+	Root string
+	Path string
+	Size int
+	Hash string
+	// Pulled tells whether the plan copies it into the origin.
+	Pulled bool
+}
+
+func (f NewFile) String() string {
+	if f.Pulled {
+		return fmt.Sprintf("%s (%s) is new, it is copied to the origin", filepath.Join(f.Root, f.Path), fs.FormatSize(f.Size))
+	}
+	return fmt.Sprintf("%s (%s) is new, it is left where it is", filepath.Join(f.Root, f.Path), fs.FormatSize(f.Size))
+}
+
+type Action int
+
+const (
+	Move Action = iota
+	Backup
+	Conflict
+)
+
+func (a Action) String() string {
+	switch a {
+	case Move:
+		return "move"
+	case Backup:
+		return "backup"
+	case Conflict:
+		return "conflict"
+	}
+	return "unknown"
+}
+
+type Rename struct {
+	fs.Rename
+	Action Action
+	Size   int
+	Hash   string
+}
+
+type Copy struct {
+	fs.Copy
+	Size int
+}
+
+type Archive struct {
+	Root    string
+	Renames []Rename
+	Copies  []Copy
+}
+
+type Plan struct {
+	Archives     []Archive
+	Fingerprints []fs.Fingerprint
+	Decisions    []Decision
+	// Agreed holds the files every archive holds once a bidirectional plan is executed in full.
+	Agreed []fs.FileMeta
+	// History holds the content of the origin after the sync, as scanned and with the copies
+	// into it, for Options.Histories.
+	History  []string
+	NewFiles []NewFile
+}
+
+// Make works out how to bring every copy in line with the origin, snapshots[0],
+// or, with Options.Bidirectional, every archive in line with the merged changes of all archives.
+// It does not modify the snapshots.
+func Make(snapshots []Snapshot, opts Options) *Plan {
+	p := &planner{opts: opts}
+	if opts.Bidirectional {
+		// The merged files take the place of the origin.
+		snapshots = append([]Snapshot{p.merge(snapshots)}, snapshots...)
+	}
+	for _, snapshot := range snapshots {
+		arc := &archive{root: snapshot.Root, files: files{}}
+		for _, meta := range snapshot.Files {
+			arc.files[meta.Path] = &file{
+				path:    meta.Path,
+				size:    meta.Size,
+				modTime: meta.ModTime,
+				hash:    meta.Hash,
+			}
+		}
+		p.archives = append(p.archives, arc)
+		p.fingerprints = append(p.fingerprints, fs.Fingerprints(snapshot.Files))
+	}
+	for path, source := range p.sources {
+		p.archives[0].files[path].source = source
+	}
+	for path := range p.skipped {
+		for _, arc := range p.archives {
+			delete(arc.files, path)
+		}
+	}
+
+	p.ignoreIdenticalDirs()
+	p.moveDirs()
+	p.ignoreIdenticalFiles()
+	p.applyPolicies()
+	p.findNewFiles()
+	p.backupExcessFiles()
+	p.resolveConflicts()
+	p.renameAndCopyFiles()
+
+	result := &Plan{Decisions: p.decisions, NewFiles: p.newFiles}
+	for i, arc := range p.archives {
+		result.Archives = append(result.Archives, Archive{
+			Root:    arc.root,
+			Renames: arc.renames,
+			Copies:  arc.copies,
+		})
+		result.Fingerprints = append(result.Fingerprints, p.fingerprints[i]["."])
+	}
+	if opts.Bidirectional {
+		result.Archives = result.Archives[1:]
+		result.Fingerprints = result.Fingerprints[1:]
+		result.Agreed = snapshots[0].Files
+	} else {
+		hashes := map[string]bool{}
+		for _, file := range snapshots[0].Files {
+			hashes[file.Hash] = true
+		}
+		for _, copy := range result.copiesInto(0) {
+			hashes[copy.Hash] = true
+		}
+		result.History = sortedKeys(hashes)
+	}
+	return result
+}
+
+// copiesInto returns the copies into archive i.
+func (p *Plan) copiesInto(i int) []Copy {
+	var result []Copy
+	for _, archive := range p.Archives {
+		for _, copy := range archive.Copies {
+			if slices.Contains(copy.ToRoots, p.Archives[i].Root) {
+				result = append(result, copy)
+			}
+		}
+	}
+	return result
+}
+
+// Identical reports whether all archives held the same content when they were scanned.
+func (p *Plan) Identical() bool {
+	for _, fp := range p.Fingerprints[1:] {
+		if fp != p.Fingerprints[0] {
+			return false
+		}
+	}
+	return true
+}
+
+// RenameCommands returns the renames of an archive in the form fs.FS.Sync expects.
+func (arc *Archive) RenameCommands() []any {
+	commands := make([]any, 0, len(arc.Renames))
+	for _, rename := range arc.Renames {
+		commands = append(commands, rename.Rename)
+	}
+	return commands
+}
+
+// CopyCommands returns the copies from an archive in the form fs.FS.Sync expects.
+func (arc *Archive) CopyCommands() []any {
+	commands := make([]any, 0, len(arc.Copies))
+	for _, copy := range arc.Copies {
+		commands = append(commands, copy.Copy)
+	}
+	return commands
+}
+
+// ConflictingFiles returns the paths whose content differs between the origin and a copy, sorted by path.
+func ConflictingFiles(snapshots []Snapshot) []ConflictingFile {
+	byPath := map[string]*ConflictingFile{}
+	for i, snapshot := range snapshots {
+		for j := range snapshot.Files {
+			meta := &snapshot.Files[j]
+			conflict, ok := byPath[meta.Path]
+			if !ok {
+				if i > 0 {
+					continue
+				}
+				conflict = &ConflictingFile{Path: meta.Path, Versions: make([]*fs.FileMeta, len(snapshots))}
+				byPath[meta.Path] = conflict
+			}
+			conflict.Versions[i] = meta
+		}
+	}
+	var result []ConflictingFile
+	for _, path := range sortedKeys(byPath) {
+		conflict := byPath[path]
+		origin := conflict.Versions[0]
+		if slices.ContainsFunc(conflict.Versions[1:], func(v *fs.FileMeta) bool { return v != nil && v.Hash != origin.Hash }) {
+			result = append(result, *conflict)
+		}
+	}
+	return result
+}
+
+// DecidedFiles returns the files the planner decided a conflict for, sorted by path. Unlike
+// ConflictingFiles, they include files deleted in the origin, as in a bidirectional sync.
+func DecidedFiles(snapshots []Snapshot, decisions []Decision) []ConflictingFile {
+	byPath := map[string]*ConflictingFile{}
+	for _, decision := range decisions {
+		byPath[decision.Path] = &ConflictingFile{Path: decision.Path, Versions: make([]*fs.FileMeta, len(snapshots))}
+	}
+	for i, snapshot := range snapshots {
+		for j := range snapshot.Files {
+			if conflict, ok := byPath[snapshot.Files[j].Path]; ok {
+				conflict.Versions[i] = &snapshot.Files[j]
+			}
+		}
+	}
+	var result []ConflictingFile
+	for _, path := range sortedKeys(byPath) {
+		result = append(result, *byPath[path])
+	}
+	return result
+}
+
+// Entry names a rename in the archive Root by its source path, or a copy of Path into Root.
+type Entry struct {
+	Root string
+	Path string
+	Copy bool
+}
+
+// Without returns the plan without the excluded entries and without the entries that depend on them:
+// renames onto a path an excluded rename would have vacated, copies onto such a path, and copies
+// from the path an excluded rename would have filled.
+func (p *Plan) Without(excluded map[Entry]bool) *Plan {
+	result := &Plan{Fingerprints: p.Fingerprints, Decisions: p.Decisions, History: p.History, NewFiles: p.NewFiles}
+	if len(excluded) == 0 {
+		// The archives only agree when the whole plan is executed.
+		result.Agreed = p.Agreed
+	}
+	// blocked holds the source paths of the renames left out by archive, and unfilled their destinations.
+	blocked := map[string][]string{}
+	unfilled := map[string][]string{}
+	isBlocked := func(root, path string) bool {
+		return slices.ContainsFunc(blocked[root], func(b string) bool { return fs.InDir(path, b) || fs.InDir(b, path) })
+	}
+	for _, archive := range p.Archives {
+		kept := Archive{Root: archive.Root}
+		for _, rename := range archive.Renames {
+			if excluded[Entry{Root: archive.Root, Path: rename.SourcePath}] || isBlocked(archive.Root, rename.DestinationPath) {
+				blocked[archive.Root] = append(blocked[archive.Root], rename.SourcePath)
+				unfilled[archive.Root] = append(unfilled[archive.Root], rename.DestinationPath)
+				continue
+			}
+			kept.Renames = append(kept.Renames, rename)
+		}
+		result.Archives = append(result.Archives, kept)
+	}
+	for i, archive := range p.Archives {
+		for _, copy := range archive.Copies {
+			if slices.ContainsFunc(unfilled[archive.Root], func(u string) bool { return fs.InDir(copy.Path, u) }) {
+				continue
+			}
+			kept := copy
+			kept.ToRoots = nil
+			for _, root := range copy.ToRoots {
+				if !excluded[Entry{Root: root, Path: copy.Path, Copy: true}] && !isBlocked(root, copy.Path) {
+					kept.ToRoots = append(kept.ToRoots, root)
+				}
+			}
+			if len(kept.ToRoots) > 0 {
+				result.Archives[i].Copies = append(result.Archives[i].Copies, kept)
+			}
+		}
+	}
+	if p.History != nil {
+		// Content no longer copied into the origin leaves the history, even when the origin held it
+		// already, so that a copy of it is reported as new rather than set aside.
+		dropped := map[string]bool{}
+		for _, copy := range p.copiesInto(0) {
+			dropped[copy.Hash] = true
+		}
+		for _, copy := range result.copiesInto(0) {
+			delete(dropped, copy.Hash)
+		}
+		result.History = slices.DeleteFunc(slices.Clone(p.History), func(hash string) bool { return dropped[hash] })
+	}
+	return result
+}
+
+type planner struct {
+	opts         Options
+	archives     []*archive
+	fingerprints []map[string]fs.Fingerprint
+	decisions    []Decision
+	newFiles     []NewFile
+	// sources and skipped are set by merge: the archive to copy each merged file from,
+	// and the paths to leave alone.
+	sources map[string]int
+	skipped map[string]bool
+}
+
+type archive struct {
+	root    string
+	files   files
+	renames []Rename
+	copies  []Copy
+	// skipped holds the paths of conflicting files left where they are.
+	skipped map[string]bool
+}
+
+type file struct {
+	path    string
+	size    int
+	modTime time.Time
+	hash    string
+	// source is the archive holding the content of an origin file that is yet to be pulled into the origin.
+	source int
+}
+
+type files map[string]*file
+
+func (p *planner) ignoreIdenticalDirs() {
+	identicalDirs := []string{}
+	for _, dir := range fs.DirPaths(p.fingerprints[0]) {
+		if inAnyDir(dir, identicalDirs) {
+			continue
+		}
+		original := p.fingerprints[0][dir]
+		hasIdentical := true
+		for _, fingerprints := range p.fingerprints[1:] {
+			if copy, ok := fingerprints[dir]; !ok || copy != original {
+				hasIdentical = false
+			}
+		}
+		if hasIdentical {
+			identicalDirs = append(identicalDirs, dir)
+		}
+	}
+	for _, arc := range p.archives {
+		for _, dir := range identicalDirs {
+			arc.removeDir(dir)
+		}
+	}
+}
+
+func (p *planner) moveDirs() {
+	if p.opts.Additive {
+		return
+	}
+	originals := p.fingerprints[0]
+	for i, arc := range p.archives[1:] {
+		copies := p.fingerprints[i+1]
+		byHash := map[string][]string{}
+		for _, dir := range fs.DirPaths(copies) {
+			hash := copies[dir].Hash
+			byHash[hash] = append(byHash[hash], dir)
+		}
+
+		moved := []string{}
+		for _, dir := range fs.DirPaths(originals) {
+			if _, ok := copies[dir]; ok || dir == "." || arc.hasDir(dir) {
+				continue
+			}
+			for _, copyDir := range byHash[originals[dir].Hash] {
+				if copyDir == "." || fs.InDir(dir, copyDir) || fs.InDir(copyDir, dir) ||
+					originals[copyDir] == copies[copyDir] || inAnyDir(copyDir, moved) ||
+					slices.ContainsFunc(moved, func(movedDir string) bool { return fs.InDir(movedDir, copyDir) }) {
+					continue
+				}
+				fp := copies[copyDir]
+				arc.renames = append(arc.renames, Rename{
+					Rename: fs.Rename{
+						SourcePath:      copyDir,
+						DestinationPath: dir,
+					},
+					Action: Move,
+					Size:   fp.Size,
+					Hash:   fp.Hash,
+				})
+				arc.moveDir(copyDir, dir)
+				moved = append(moved, copyDir)
+				break
+			}
+		}
+	}
+}
+
+func (p *planner) ignoreIdenticalFiles() {
+	identicalFiles := []string{}
+	for _, original := range p.archives[0].files {
+		hasIdentical := true
+		for _, arc := range p.archives[1:] {
+			copy, ok := arc.files[original.path]
+			if !ok || original.size != copy.size || original.hash != copy.hash {
+				hasIdentical = false
+			}
+		}
+		if hasIdentical {
+			identicalFiles = append(identicalFiles, original.path)
+		}
+	}
+	for _, arc := range p.archives {
+		for _, path := range identicalFiles {
+			delete(arc.files, path)
+		}
+	}
+}
+
+// applyPolicies decides every conflicting file. It makes the origin hold the winning version,
+// as if it had been there all along, and remembers where to pull it from; skipped files leave the sync
+// in the copies whose version conflicts.
+// Later steps then bring the copies in line with that origin.
+func (p *planner) applyPolicies() {
+	if p.opts.Bidirectional {
+		// merge has applied them.
+		return
+	}
+	origin := p.archives[0]
+	for _, path := range sortedKeys(origin.files) {
+		original := origin.files[path]
+		versions := []*file{original}
+		for _, arc := range p.archives[1:] {
+			versions = append(versions, arc.files[path])
+		}
+		if !slices.ContainsFunc(versions[1:], func(v *file) bool { return v != nil && v.hash != original.hash }) {
+			continue
+		}
+
+		resolution := p.resolution(path)
+		decision := Decision{Path: path, Policy: resolution.Policy, Winner: origin.root}
+		switch resolution.Policy {
+		case NewestWins, LargestWins, CopyWins:
+			winner := resolution.Archive
+			if resolution.Policy != CopyWins {
+				winner = 0
+				for i, v := range versions {
+					if v != nil && (resolution.Policy == NewestWins && v.modTime.After(versions[winner].modTime) ||
+						resolution.Policy == LargestWins && v.size > versions[winner].size) {
+						winner = i
+					}
+				}
+			}
+			if winner <= 0 || winner >= len(versions) || versions[winner] == nil || versions[winner].hash == original.hash {
+				break
+			}
+			decision.Winner = p.archives[winner].root
+			origin.renames = append(origin.renames, Rename{
+				Rename: fs.Rename{
+					SourcePath:      path,
+					DestinationPath: filepath.Join(p.opts.Backup, path),
+				},
+				Action: Conflict,
+				Size:   original.size,
+				Hash:   original.hash,
+			})
+			w := *versions[winner]
+			w.source = winner
+			origin.files[path] = &w
+
+		case KeepBoth:
+			for i, v := range versions {
+				if i == 0 || v == nil || v.hash == original.hash {
+					continue
+				}
+				newPath := bothName(path, v.hash)
+				p.archives[i].renames = append(p.archives[i].renames, Rename{
+					Rename: fs.Rename{
+						SourcePath:      path,
+						DestinationPath: newPath,
+					},
+					Action: Conflict,
+					Size:   v.size,
+					Hash:   v.hash,
+				})
+				delete(p.archives[i].files, path)
+				v.path = newPath
+				p.archives[i].files[newPath] = v
+				if _, ok := origin.files[newPath]; !ok {
+					kept := *v
+					kept.source = i
+					origin.files[newPath] = &kept
+				}
+			}
+
+		case Skip:
+			decision.Winner = ""
+			for i, v := range versions {
+				if i > 0 && v != nil && v.hash != original.hash {
+					p.archives[i].skip(path)
+				}
+			}
+		}
+		p.decisions = append(p.decisions, decision)
+	}
+}
+
+// resolution returns the resolution of the path, the first matching rule or the default policy.
+func (p *planner) resolution(path string) Resolution {
+	if p.opts.Additive {
+		return Resolution{Policy: Skip}
+	}
+	if resolution, ok := p.opts.Resolutions[path]; ok {
+		return resolution
+	}
+	for _, rule := range p.opts.Rules {
+		if rule.Matches(path) {
+			return Resolution{Policy: rule.Policy}
+		}
+	}
+	return Resolution{Policy: p.opts.Policy}
+}
+
+// matches tells whether the pattern matches the file or one of its folders.
+func matches(pattern, path string) bool {
+	if fs.Match(pattern, path, false) {
+		return true
+	}
+	for dir := filepath.Dir(path); dir != "."; dir = filepath.Dir(dir) {
+		if fs.Match(pattern, dir, true) {
+			return true
+		}
+	}
+	return false
+}
+
+
+// findNewFiles finds the files of the copies whose content the origin never had, and makes the origin
+// hold the ones to pull. The others stay where they are. Copies without a history have none.
+func (p *planner) findNewFiles() {
+	if p.opts.Bidirectional || p.opts.Additive {
+		return
+	}
+	origin := p.archives[0]
+	originals := origin.byHash()
+	for i, arc := range p.archives[1:] {
+		if i+1 >= len(p.opts.Histories) || p.opts.Histories[i+1] == nil {
+			continue
+		}
+		history := p.opts.Histories[i+1]
+		for _, path := range sortedKeys(arc.files) {
+			file := arc.files[path]
+			if _, ok := origin.files[path]; ok || history[file.hash] || len(originals[file.hash]) > 0 {
+				// Conflicting files are left to the policies.
+				continue
+			}
+			newFile := NewFile{Root: arc.root, Path: path, Size: file.size, Hash: file.hash, Pulled: p.opts.PullNew}
+			if newFile.Pulled {
+				pulled := *file
+				pulled.source = i + 1
+				origin.files[path] = &pulled
+				originals[file.hash] = append(originals[file.hash], path)
+			} else {
+				delete(arc.files, path)
+			}
+			p.newFiles = append(p.newFiles, newFile)
+		}
+	}
+}
+
+// bothName names the version of a file with the given hash when both versions are kept.
+func bothName(path, hash string) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s~%s%s", strings.TrimSuffix(path, ext), hash[:min(8, len(hash))], ext)
+}
+
+func (p *planner) backupExcessFiles() {
+	if p.opts.Additive {
+		return
+	}
+	originals := p.archives[0].byHash()
+	for _, arc := range p.archives[1:] {
+		copies := arc.byHash()
+		for _, hash := range sortedKeys(copies) {
+			originalFiles := originals[hash]
+			copyFiles := copies[hash]
+
+			if len(originalFiles) >= len(copyFiles) {
+				continue
+			}
+			_, _, excessFiles := pairPaths(originalFiles, copyFiles)
+			for _, path := range excessFiles {
+				arc.renames = append(arc.renames, Rename{
+					Rename: fs.Rename{
+						SourcePath:      path,
+						DestinationPath: filepath.Join(p.opts.Backup, path),
+					},
+					Action: Backup,
+					Size:   arc.files[path].size,
+					Hash:   hash,
+				})
+				delete(arc.files, path)
+			}
+		}
+	}
+}
+
+func (p *planner) resolveConflicts() {
+	for _, path := range sortedKeys(p.archives[0].files) {
+		file := p.archives[0].files[path]
+		for _, arc := range p.archives[1:] {
+			if other, ok := arc.files[file.path]; ok {
+				if file.hash == other.hash {
+					continue
+				}
+				dir, name := filepath.Split(other.path)
+				newPath := filepath.Join(dir, p.opts.Backup+name)
+				if p.opts.Bidirectional {
+					// A file next to the original would spread to the other archives as a new file.
+					newPath = filepath.Join(p.opts.Backup, other.path)
+				}
+				arc.renames = append(arc.renames, Rename{
+					Rename: fs.Rename{
+						SourcePath:      other.path,
+						DestinationPath: newPath,
+					},
+					Action: Conflict,
+					Size:   other.size,
+					Hash:   other.hash,
+				})
+				other.path = newPath
+				arc.files[newPath] = other
+				delete(arc.files, file.path)
+			}
+		}
+	}
+}
+
+func (p *planner) renameAndCopyFiles() {
+	toCopy := map[string][]string{}
+	// holders are the copies that hold an origin file at its path and leave it there.
+	holders := map[string][]int{}
+	originalsByHash := p.archives[0].byHash()
+	for i, arc := range p.archives[1:] {
+		if p.opts.Additive {
+			// Conflicting files are skipped, so the copy holds every origin file it has a path for.
+			for path, original := range p.archives[0].files {
+				if file, ok := arc.files[path]; !ok {
+					if !arc.skipped[path] {
+						toCopy[path] = append(toCopy[path], arc.root)
+					}
+				} else if file.hash == original.hash {
+					holders[path] = append(holders[path], i+1)
+				}
+			}
+			continue
+		}
+		copiesByHash := arc.byHash()
+		for _, hash := range sortedKeys(originalsByHash) {
+			pairs, missing, _ := pairPaths(originalsByHash[hash], copiesByHash[hash])
+			for _, pair := range pairs {
+				if pair.original == pair.copy {
+					if !arc.renamedInto(pair.copy) {
+						holders[pair.copy] = append(holders[pair.copy], i+1)
+					}
+					continue
+				}
+				arc.renames = append(arc.renames, Rename{
+					Rename: fs.Rename{
+						SourcePath:      pair.copy,
+						DestinationPath: pair.original,
+					},
+					Action: Move,
+					Size:   arc.files[pair.copy].size,
+					Hash:   hash,
+				})
+			}
+			for _, original := range missing {
+				if !arc.skipped[original] {
+					toCopy[original] = append(toCopy[original], arc.root)
+				}
+			}
+		}
+	}
+	origin := p.archives[0]
+	for path, file := range origin.files {
+		if file.source != 0 && !p.opts.Bidirectional {
+			toCopy[path] = append([]string{origin.root}, toCopy[path]...)
+		}
+	}
+	sources := p.chooseSources(toCopy, holders)
+	for _, path := range sortedKeys(toCopy) {
+		file := origin.files[path]
+		source := p.archives[sources[path]]
+		source.copies = append(source.copies, Copy{
+			Copy: fs.Copy{
+				Path:    path,
+				Hash:    file.hash,
+				ToRoots: toCopy[path],
+			},
+			Size: file.size,
+		})
+	}
+	for _, arc := range p.archives {
+		p.sortCopies(arc)
+	}
+}
+
+// sortCopies sorts the copies of the archive by priority, then by Options.Order; copies are sorted by path.
+func (p *planner) sortCopies(arc *archive) {
+	type key struct {
+		priority int
+		value    int64
+	}
+	keys := map[string]key{}
+	for _, copy := range arc.copies {
+		k := key{priority: len(p.opts.Priorities)}
+		for i, pattern := range p.opts.Priorities {
+			if matches(pattern, copy.Path) {
+				k.priority = i
+				break
+			}
+		}
+		switch p.opts.Order {
+		case SmallestFirst:
+			k.value = int64(copy.Size)
+		case ByDiskOffset:
+			k.value = math.MaxInt64
+			if p.opts.Offset != nil {
+				if offset, ok := p.opts.Offset(arc.root, copy.Path); ok {
+					k.value = offset
+				}
+			}
+		}
+		keys[copy.Path] = k
+	}
+	slices.SortStableFunc(arc.copies, func(a, b Copy) int {
+		ka, kb := keys[a.Path], keys[b.Path]
+		if ka.priority != kb.priority {
+			return ka.priority - kb.priority
+		}
+		return cmp.Compare(ka.value, kb.value)
+	})
+}
+
+// chooseSources picks the archive to copy every file from among the one holding its content
+// for the origin and the holders: the largest files first, each from the archive that would be
+// done reading soonest, so that the archives read in parallel and fast ones read more.
+func (p *planner) chooseSources(toCopy map[string][]string, holders map[string][]int) map[string]int {
+	speeds := p.speeds()
+	busy := make([]float64, len(p.archives))
+	paths := sortedKeys(toCopy)
+	origin := p.archives[0]
+	slices.SortStableFunc(paths, func(a, b string) int { return origin.files[b].size - origin.files[a].size })
+	sources := map[string]int{}
+	for _, path := range paths {
+		file := origin.files[path]
+		source := file.source
+		for _, holder := range holders[path] {
+			if busy[holder]+float64(file.size)/speeds[holder] < busy[source]+float64(file.size)/speeds[source] {
+				source = holder
+			}
+		}
+		busy[source] += float64(file.size) / speeds[source]
+		sources[path] = source
+	}
+	return sources
+}
+
+// speeds returns the read speed of every archive; unknown speeds are taken to be the average known one.
+func (p *planner) speeds() []float64 {
+	known := p.opts.Speeds
+	if p.opts.Bidirectional && known != nil {
+		// Nothing is read from the merged files.
+		known = append([]float64{0}, known...)
+	}
+	speeds := make([]float64, len(p.archives))
+	total, n := 0.0, 0
+	for i := range speeds {
+		if i < len(known) && known[i] > 0 {
+			speeds[i] = known[i]
+			total += known[i]
+			n++
+		}
+	}
+	for i := range speeds {
+		if speeds[i] == 0 {
+			speeds[i] = 1
+			if n > 0 {
+				speeds[i] = total / float64(n)
+			}
+		}
+	}
+	return speeds
+}
+
+// merge compares every archive with the base and returns the files they should all hold:
+// a file changed, added or deleted in one archive is changed, added or deleted everywhere,
+// and the policies decide files changed differently in several archives.
+// The files are indexed by archive + 1 in sources, as the merged files precede the archives.
+func (p *planner) merge(snapshots []Snapshot) Snapshot {
+	p.sources = map[string]int{}
+	p.skipped = map[string]bool{}
+	byPath := map[string][]*fs.FileMeta{}
+	versions := func(path string) []*fs.FileMeta {
+		if byPath[path] == nil {
+			byPath[path] = make([]*fs.FileMeta, len(snapshots))
+		}
+		return byPath[path]
+	}
+	for i, snapshot := range snapshots {
+		for j := range snapshot.Files {
+			versions(snapshot.Files[j].Path)[i] = &snapshot.Files[j]
+		}
+	}
+	base := map[string]*fs.FileMeta{}
+	for i := range p.opts.Base {
+		base[p.opts.Base[i].Path] = &p.opts.Base[i]
+		versions(p.opts.Base[i].Path)
+	}
+
+	merged := Snapshot{}
+	add := func(path string, source int, meta *fs.FileMeta) {
+		file := *meta
+		file.Path = path
+		merged.Files = append(merged.Files, file)
+		p.sources[path] = source + 1
+	}
+	for _, path := range sortedKeys(byPath) {
+		vs := byPath[path]
+		var changed []int
+		for i, v := range vs {
+			if !sameFile(v, base[path]) {
+				changed = append(changed, i)
+			}
+		}
+		if len(changed) == 0 {
+			add(path, 0, base[path])
+			continue
+		}
+		if !slices.ContainsFunc(changed, func(i int) bool { return !sameFile(vs[i], vs[changed[0]]) }) {
+			if vs[changed[0]] != nil {
+				add(path, changed[0], vs[changed[0]])
+			}
+			continue
+		}
+
+		resolution := p.resolution(path)
+		winner := p.winner(resolution, vs, changed)
+		decision := Decision{Path: path, Policy: resolution.Policy}
+		switch {
+		case resolution.Policy == Skip:
+			p.skipped[path] = true
+		case vs[winner] == nil:
+			decision.Winner = snapshots[winner].Root
+		default:
+			decision.Winner = snapshots[winner].Root
+			add(path, winner, vs[winner])
+		}
+		if resolution.Policy == KeepBoth {
+			for _, i := range changed {
+				if vs[i] != nil && vs[i].Hash != vs[winner].Hash {
+					add(bothName(path, vs[i].Hash), i, vs[i])
+				}
+			}
+		}
+		p.decisions = append(p.decisions, decision)
+	}
+	return merged
+}
+
+// winner returns the archive whose version of a file changed in several archives wins.
+// OriginWins picks the first listed archive that changed the file, so deleting a file only wins
+// over changing it when that archive deleted it; the other policies pick among the present versions.
+func (p *planner) winner(resolution Resolution, vs []*fs.FileMeta, changed []int) int {
+	present := slices.DeleteFunc(slices.Clone(changed), func(i int) bool { return vs[i] == nil })
+	winner := present[0]
+	switch resolution.Policy {
+	case OriginWins:
+		winner = changed[0]
+	case CopyWins:
+		if resolution.Archive < len(vs) && vs[resolution.Archive] != nil {
+			winner = resolution.Archive
+		}
+	case NewestWins:
+		for _, i := range present {
+			if vs[i].ModTime.After(vs[winner].ModTime) {
+				winner = i
+			}
+		}
+	case LargestWins:
+		for _, i := range present {
+			if vs[i].Size > vs[winner].Size {
+				winner = i
+			}
+		}
+	}
+	return winner
+}
+
+// sameFile tells whether two versions of a file, nil where it is absent, hold the same content.
+func sameFile(a, b *fs.FileMeta) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Hash == b.Hash
+}
+
+type pathPair struct {
+	original string
+	copy     string
+}
+
+// pairPaths matches copies to originals holding the same content so that as few files as possible
+// have to move: identical paths first, then the same file name, then the same folder, then whatever is left.
+// The result depends only on the paths, never on the order they are given in.
+func pairPaths(originals, copies []string) (pairs []pathPair, unpairedOriginals, unpairedCopies []string) {
+	unpairedOriginals = slices.Sorted(slices.Values(originals))
+	unpairedCopies = slices.Sorted(slices.Values(copies))
+
+	matchers := []func(original, copy string) bool{
+		func(original, copy string) bool { return original == copy },
+		func(original, copy string) bool { return filepath.Base(original) == filepath.Base(copy) },
+		func(original, copy string) bool { return filepath.Dir(original) == filepath.Dir(copy) },
+		func(original, copy string) bool { return true },
+	}
+	for _, match := range matchers {
+		unpaired := unpairedOriginals[:0:0]
+		for _, original := range unpairedOriginals {
+			idx := slices.IndexFunc(unpairedCopies, func(copy string) bool { return match(original, copy) })
+			if idx < 0 {
+				unpaired = append(unpaired, original)
+				continue
+			}
+			pairs = append(pairs, pathPair{original: original, copy: unpairedCopies[idx]})
+			unpairedCopies = slices.Delete(unpairedCopies, idx, idx+1)
+		}
+		unpairedOriginals = unpaired
+	}
+	return pairs, unpairedOriginals, unpairedCopies
+}
+
+func (arc *archive) byHash() map[string][]string {
+	result := map[string][]string{}
+	for _, file := range arc.files {
+		paths := result[file.hash]
+		paths = append(paths, file.path)
+		result[file.hash] = paths
+	}
+	return result
+}
+
+// skip leaves the file at path out of the sync of the archive.
+func (arc *archive) skip(path string) {
+	if arc.skipped == nil {
+		arc.skipped = map[string]bool{}
+	}
+	arc.skipped[path] = true
+	delete(arc.files, path)
+}
+
+// renamedInto tells whether a rename of the archive ends at the path or at one of its folders.
+func (arc *archive) renamedInto(path string) bool {
+	return slices.ContainsFunc(arc.renames, func(r Rename) bool { return fs.InDir(path, r.DestinationPath) })
+}
+
+func (arc *archive) hasDir(dir string) bool {
+	for path := range arc.files {
+		if fs.InDir(path, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+func (arc *archive) removeDir(dir string) {
+	for path := range arc.files {
+		if fs.InDir(path, dir) {
+			delete(arc.files, path)
+		}
+	}
+}
+
+func (arc *archive) moveDir(from, to string) {
+	for path, file := range arc.files {
+		if fs.InDir(path, from) {
+			delete(arc.files, path)
+			file.path = to + strings.TrimPrefix(path, from)
+			arc.files[file.path] = file
+		}
+	}
+}
+
+func inAnyDir(path string, dirs []string) bool {
+	return slices.ContainsFunc(dirs, func(dir string) bool { return fs.InDir(path, dir) })
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	return slices.Sorted(maps.Keys(m))
+}
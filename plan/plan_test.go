@@ -0,0 +1,519 @@
+package plan
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"dup/fs"
+)
+
+const backup = "~~~backup~~~"
+
+func snapshot(root string, files ...string) Snapshot {
+	result := Snapshot{Root: root}
+	for i := 0; i < len(files); i += 2 {
+		result.Files = append(result.Files, fs.FileMeta{
+			Path: files[i],
+			Size: len(files[i+1]),
+			Hash: files[i+1],
+		})
+	}
+	return result
+}
+
+func renames(p *Plan, idx int) []fs.Rename {
+	var result []fs.Rename
+	for _, rename := range p.Archives[idx].Renames {
+		result = append(result, rename.Rename)
+	}
+	return result
+}
+
+func copies(p *Plan, idx int) []fs.Copy {
+	var result []fs.Copy
+	for _, copy := range p.Archives[idx].Copies {
+		result = append(result, copy.Copy)
+	}
+	return result
+}
+
+func check[T any](t *testing.T, name string, got, want T) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s:\n got  %v\n want %v", name, got, want)
+	}
+}
+
+func TestIdenticalArchives(t *testing.T) {
+	p := Make([]Snapshot{
+		snapshot("origin", "a/b", "hash-1", "c", "hash-2"),
+		snapshot("copy", "c", "hash-2", "a/b", "hash-1"),
+	}, Options{Backup: backup})
+
+	if !p.Identical() {
+		t.Errorf("archives are not identical: %v", p.Fingerprints)
+	}
+	check(t, "renames", renames(p, 1), nil)
+	check(t, "copies", copies(p, 0), nil)
+}
+
+func TestMissingFilesAreCopied(t *testing.T) {
+	p := Make([]Snapshot{
+		snapshot("origin", "a", "hash-1", "b", "hash-2"),
+		snapshot("copy 1", "a", "hash-1"),
+		snapshot("copy 2"),
+	}, Options{Backup: backup})
+
+	if p.Identical() {
+		t.Errorf("archives are identical")
+	}
+	check(t, "copies", copies(p, 0), []fs.Copy{
+		{Path: "a", Hash: "hash-1", ToRoots: []string{"copy 2"}},
+		{Path: "b", Hash: "hash-2", ToRoots: []string{"copy 1", "copy 2"}},
+	})
+	check(t, "size", p.Archives[0].Copies[1].Size, len("hash-2"))
+}
+
+func TestMovedFilesAreRenamed(t *testing.T) {
+	p := Make([]Snapshot{
+		snapshot("origin", "new/name", "hash-1"),
+		snapshot("copy", "old/name", "hash-1", "other", "hash-2"),
+	}, Options{Backup: backup})
+
+	check(t, "renames", renames(p, 1), []fs.Rename{
+		{SourcePath: "old", DestinationPath: "new"},
+		{SourcePath: "other", DestinationPath: backup + "/other"},
+	})
+	check(t, "actions", []Action{p.Archives[1].Renames[0].Action, p.Archives[1].Renames[1].Action}, []Action{Move, Backup})
+	check(t, "copies", copies(p, 0), nil)
+}
+
+func TestMovedFolderIsRenamedAsAWhole(t *testing.T) {
+	p := Make([]Snapshot{
+		snapshot("origin", "photos/2024/a", "hash-1", "photos/2024/b", "hash-2", "c", "hash-3"),
+		snapshot("copy", "2024/a", "hash-1", "2024/b", "hash-2", "c", "hash-3"),
+	}, Options{Backup: backup})
+
+	check(t, "renames", renames(p, 1), []fs.Rename{
+		{SourcePath: "2024", DestinationPath: "photos/2024"},
+	})
+	check(t, "copies", copies(p, 0), nil)
+}
+
+func TestDuplicatesArePairedByPath(t *testing.T) {
+	p := Make([]Snapshot{
+		snapshot("origin", "a/x.jpg", "hash-1", "b/x.jpg", "hash-1", "c/y.jpg", "hash-1"),
+		snapshot("copy", "b/x.jpg", "hash-1", "d/x.jpg", "hash-1", "c/z.jpg", "hash-1", "c/w.jpg", "hash-1"),
+	}, Options{Backup: backup})
+
+	check(t, "renames", renames(p, 1), []fs.Rename{
+		{SourcePath: "d", DestinationPath: "a"},
+		{SourcePath: "c/z.jpg", DestinationPath: backup + "/c/z.jpg"},
+		{SourcePath: "c/w.jpg", DestinationPath: "c/y.jpg"},
+	})
+	check(t, "copies", copies(p, 0), nil)
+}
+
+func TestDuplicatesAreCopied(t *testing.T) {
+	p := Make([]Snapshot{
+		snapshot("origin", "a", "hash-1", "b", "hash-1"),
+		snapshot("copy", "b", "hash-1"),
+	}, Options{Backup: backup})
+
+	check(t, "renames", renames(p, 1), nil)
+	check(t, "copies", copies(p, 0), []fs.Copy{
+		{Path: "a", Hash: "hash-1", ToRoots: []string{"copy"}},
+	})
+}
+
+func TestCopiesAreSpreadOverTheArchivesHoldingTheFiles(t *testing.T) {
+	snapshots := []Snapshot{
+		snapshot("origin", "a", "hash-1", "b", "hash-22", "moved/c", "hash-3"),
+		snapshot("copy 1", "a", "hash-1", "b", "hash-22", "c", "hash-3"),
+		snapshot("copy 2"),
+	}
+	p := Make(snapshots, Options{Backup: backup})
+
+	check(t, "copies from the origin", copies(p, 0), []fs.Copy{
+		{Path: "b", Hash: "hash-22", ToRoots: []string{"copy 2"}},
+		{Path: "moved/c", Hash: "hash-3", ToRoots: []string{"copy 2"}},
+	})
+	check(t, "copies from copy 1", copies(p, 1), []fs.Copy{
+		{Path: "a", Hash: "hash-1", ToRoots: []string{"copy 2"}},
+	})
+
+	p = Make(snapshots, Options{Backup: backup, Speeds: []float64{1, 100, 0}})
+	check(t, "copies from the slow origin", copies(p, 0), []fs.Copy{
+		{Path: "moved/c", Hash: "hash-3", ToRoots: []string{"copy 2"}},
+	})
+	check(t, "copies from fast copy 1", copies(p, 1), []fs.Copy{
+		{Path: "a", Hash: "hash-1", ToRoots: []string{"copy 2"}},
+		{Path: "b", Hash: "hash-22", ToRoots: []string{"copy 2"}},
+	})
+}
+
+func TestCopyOrder(t *testing.T) {
+	snapshots := []Snapshot{
+		snapshot("origin", "a.mov", "hash-333", "b.pdf", "hash-22", "c.mov", "hash-1", "docs/d", "hash-4444"),
+		snapshot("copy"),
+	}
+	order := func(opts Options) []string {
+		var paths []string
+		for _, copy := range copies(Make(snapshots, opts), 0) {
+			paths = append(paths, copy.Path)
+		}
+		return paths
+	}
+
+	check(t, "by path", order(Options{}), []string{"a.mov", "b.pdf", "c.mov", "docs/d"})
+	check(t, "smallest first", order(Options{Order: SmallestFirst}), []string{"c.mov", "b.pdf", "a.mov", "docs/d"})
+	check(t, "priorities", order(Options{Priorities: []string{"docs/", "*.pdf"}, Order: SmallestFirst}),
+		[]string{"docs/d", "b.pdf", "c.mov", "a.mov"})
+	offsets := map[string]int64{"a.mov": 3, "c.mov": 1, "docs/d": 2}
+	check(t, "by disk offset", order(Options{Order: ByDiskOffset, Offset: func(root, path string) (int64, bool) {
+		offset, ok := offsets[path]
+		return offset, ok
+	}}), []string{"c.mov", "docs/d", "a.mov", "b.pdf"})
+}
+
+func TestConflictsAreSetAside(t *testing.T) {
+	p := Make([]Snapshot{
+		snapshot("origin", "dir/a", "hash-1", "b", "hash-2"),
+		snapshot("copy", "dir/a", "hash-2"),
+	}, Options{Backup: backup})
+
+	check(t, "renames", renames(p, 1), []fs.Rename{
+		{SourcePath: "dir/a", DestinationPath: "dir/" + backup + "a"},
+		{SourcePath: "dir/" + backup + "a", DestinationPath: "b"},
+	})
+	check(t, "action", p.Archives[1].Renames[0].Action, Conflict)
+	check(t, "copies", copies(p, 0), []fs.Copy{
+		{Path: "dir/a", Hash: "hash-1", ToRoots: []string{"copy"}},
+	})
+}
+
+func TestSwappedFiles(t *testing.T) {
+	p := Make([]Snapshot{
+		snapshot("origin", "a", "hash-1", "b", "hash-2"),
+		snapshot("copy", "a", "hash-2", "b", "hash-1"),
+	}, Options{Backup: backup})
+
+	check(t, "renames", renames(p, 1), []fs.Rename{
+		{SourcePath: "a", DestinationPath: backup + "a"},
+		{SourcePath: "b", DestinationPath: backup + "b"},
+		{SourcePath: backup + "b", DestinationPath: "a"},
+		{SourcePath: backup + "a", DestinationPath: "b"},
+	})
+	check(t, "copies", copies(p, 0), nil)
+}
+
+func TestExcessFilesAreBackedUp(t *testing.T) {
+	p := Make([]Snapshot{
+		snapshot("origin", "a", "hash-1"),
+		snapshot("copy", "a", "hash-1", "b", "hash-2", "c/d", "hash-3"),
+	}, Options{Backup: backup})
+
+	check(t, "renames", renames(p, 1), []fs.Rename{
+		{SourcePath: "b", DestinationPath: backup + "/b"},
+		{SourcePath: "c/d", DestinationPath: backup + "/c/d"},
+	})
+}
+
+func TestPlanIsDeterministic(t *testing.T) {
+	snapshots := []Snapshot{
+		snapshot("origin", "a", "hash-1", "b", "hash-1", "c", "hash-1", "d", "hash-2", "e", "hash-3"),
+		snapshot("copy 1", "x", "hash-1", "y", "hash-1", "z", "hash-2", "e", "hash-4"),
+		snapshot("copy 2", "q", "hash-1", "r", "hash-1", "s", "hash-1", "t", "hash-1"),
+	}
+	first := Make(snapshots, Options{Backup: backup})
+	for range 20 {
+		check(t, "plan", Make(snapshots, Options{Backup: backup}), first)
+	}
+}
+
+func TestSnapshotsAreNotModified(t *testing.T) {
+	snapshots := []Snapshot{
+		snapshot("origin", "a", "hash-1"),
+		snapshot("copy", "b", "hash-1", "c", "hash-2"),
+	}
+	want := []Snapshot{
+		snapshot("origin", "a", "hash-1"),
+		snapshot("copy", "b", "hash-1", "c", "hash-2"),
+	}
+	Make(snapshots, Options{Backup: backup})
+	check(t, "snapshots", snapshots, want)
+}
+
+func TestExcludedEntriesAndTheirDependents(t *testing.T) {
+	p := Make([]Snapshot{
+		snapshot("origin", "a", "hash-1", "b", "hash-2", "c", "hash-3"),
+		snapshot("copy 1", "a", "hash-4", "old-b", "hash-2"),
+		snapshot("copy 2", "a", "hash-5"),
+	}, Options{Backup: backup})
+
+	without := p.Without(map[Entry]bool{
+		{Root: "copy 1", Path: "a"}:             true,
+		{Root: "copy 2", Path: "c", Copy: true}: true,
+	})
+
+	check(t, "renames 1", renames(without, 1), []fs.Rename{{SourcePath: "old-b", DestinationPath: "b"}})
+	check(t, "renames 2", renames(without, 2), []fs.Rename{{SourcePath: "a", DestinationPath: backup + "/a"}})
+	check(t, "copies", copies(without, 0), []fs.Copy{
+		{Path: "a", Hash: "hash-1", ToRoots: []string{"copy 2"}},
+		{Path: "b", Hash: "hash-2", ToRoots: []string{"copy 2"}},
+		{Path: "c", Hash: "hash-3", ToRoots: []string{"copy 1"}},
+	})
+	check(t, "original", len(copies(p, 0)[0].ToRoots), 2)
+
+	// The version kept under another name is only there if its rename is.
+	p = Make([]Snapshot{
+		snapshot("origin", "dir/a.txt", "hash-1"),
+		snapshot("copy 1", "dir/a.txt", "hash-2"),
+		snapshot("copy 2"),
+	}, Options{Backup: backup, Resolutions: map[string]Resolution{"dir/a.txt": {Policy: KeepBoth}}})
+	without = p.Without(map[Entry]bool{{Root: "copy 1", Path: "dir/a.txt"}: true})
+
+	check(t, "kept both renames", renames(without, 1), nil)
+	check(t, "kept both origin copies", copies(without, 0), []fs.Copy{
+		{Path: "dir/a.txt", Hash: "hash-1", ToRoots: []string{"copy 2"}},
+	})
+	check(t, "kept both copy 1 copies", copies(without, 1), nil)
+}
+
+func TestCopyWinsPullsTheCopysVersion(t *testing.T) {
+	p := Make([]Snapshot{
+		snapshot("origin", "a", "hash-1"),
+		snapshot("copy 1", "a", "hash-2"),
+		snapshot("copy 2", "a", "hash-1"),
+	}, Options{Backup: backup, Resolutions: map[string]Resolution{"a": {Policy: CopyWins, Archive: 1}}})
+
+	check(t, "origin renames", renames(p, 0), []fs.Rename{{SourcePath: "a", DestinationPath: backup + "/a"}})
+	check(t, "copy 2 renames", renames(p, 2), []fs.Rename{{SourcePath: "a", DestinationPath: backup + "/a"}})
+	check(t, "origin copies", copies(p, 0), nil)
+	check(t, "copy 1 copies", copies(p, 1), []fs.Copy{
+		{Path: "a", Hash: "hash-2", ToRoots: []string{"origin", "copy 2"}},
+	})
+	// The history holds the content copied into the origin, unless the copy is left out.
+	check(t, "history", p.History, []string{"hash-1", "hash-2"})
+	check(t, "history without", p.Without(map[Entry]bool{{Root: "origin", Path: "a", Copy: true}: true}).History, []string{"hash-1"})
+}
+
+func TestNewestWins(t *testing.T) {
+	older, newer := snapshot("origin", "a", "hash-1"), snapshot("copy", "a", "hash-2")
+	older.Files[0].ModTime = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer.Files[0].ModTime = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	resolutions := map[string]Resolution{"a": {Policy: NewestWins}}
+
+	p := Make([]Snapshot{older, newer}, Options{Backup: backup, Resolutions: resolutions})
+	check(t, "copies from copy", copies(p, 1), []fs.Copy{{Path: "a", Hash: "hash-2", ToRoots: []string{"origin"}}})
+
+	older.Root, newer.Root = "copy", "origin"
+	p = Make([]Snapshot{newer, older}, Options{Backup: backup, Resolutions: resolutions})
+	check(t, "copies from origin", copies(p, 0), []fs.Copy{{Path: "a", Hash: "hash-2", ToRoots: []string{"copy"}}})
+	check(t, "origin renames", renames(p, 0), nil)
+}
+
+func TestKeepBoth(t *testing.T) {
+	p := Make([]Snapshot{
+		snapshot("origin", "dir/a.txt", "hash-1"),
+		snapshot("copy 1", "dir/a.txt", "hash-2"),
+		snapshot("copy 2"),
+	}, Options{Backup: backup, Resolutions: map[string]Resolution{"dir/a.txt": {Policy: KeepBoth}}})
+
+	check(t, "renames", renames(p, 1), []fs.Rename{{SourcePath: "dir/a.txt", DestinationPath: "dir/a~hash-2.txt"}})
+	check(t, "origin copies", copies(p, 0), []fs.Copy{
+		{Path: "dir/a.txt", Hash: "hash-1", ToRoots: []string{"copy 1", "copy 2"}},
+	})
+	check(t, "copy 1 copies", copies(p, 1), []fs.Copy{
+		{Path: "dir/a~hash-2.txt", Hash: "hash-2", ToRoots: []string{"origin", "copy 2"}},
+	})
+}
+
+func TestConflictingFiles(t *testing.T) {
+	snapshots := []Snapshot{
+		snapshot("origin", "a", "hash-1", "b", "hash-2", "c", "hash-3"),
+		snapshot("copy 1", "a", "hash-1", "b", "hash-4"),
+		snapshot("copy 2", "a", "hash-5", "d", "hash-6"),
+	}
+	conflicts := ConflictingFiles(snapshots)
+
+	paths := []string{}
+	for _, conflict := range conflicts {
+		paths = append(paths, conflict.Path)
+	}
+	check(t, "paths", paths, []string{"a", "b"})
+	check(t, "absent", conflicts[1].Versions[2] == nil, true)
+}
+
+func TestDecidedFilesIncludeDeletedOnes(t *testing.T) {
+	base := snapshot("", "a", "hash-1", "b", "hash-2")
+	snapshots := []Snapshot{snapshot("a", "b", "hash-3"), snapshot("b", "a", "hash-4", "b", "hash-2")}
+	p := Make(snapshots, Options{Backup: backup, Bidirectional: true, Base: base.Files})
+
+	decided := DecidedFiles(snapshots, p.Decisions)
+	check(t, "paths", len(decided), 1)
+	check(t, "path", decided[0].Path, "a")
+	check(t, "deleted", decided[0].Versions[0] == nil, true)
+	check(t, "changed", decided[0].Versions[1].Hash, "hash-4")
+	check(t, "rule", Rule{Pattern: "dir/", Policy: Skip}.Matches("dir/sub/a"), true)
+}
+
+func TestLargestWins(t *testing.T) {
+	p := Make([]Snapshot{
+		snapshot("origin", "a", "hash-1"),
+		snapshot("copy", "a", "longer-hash-2"),
+	}, Options{Backup: backup, Policy: LargestWins})
+
+	check(t, "copies", copies(p, 1), []fs.Copy{{Path: "a", Hash: "longer-hash-2", ToRoots: []string{"origin"}}})
+	check(t, "decisions", p.Decisions, []Decision{{Path: "a", Policy: LargestWins, Winner: "copy"}})
+}
+
+func TestSkippedFilesAreLeftAlone(t *testing.T) {
+	p := Make([]Snapshot{
+		snapshot("origin", "a", "hash-1", "b", "hash-3"),
+		snapshot("copy", "a", "hash-2"),
+	}, Options{Backup: backup, Policy: Skip})
+
+	check(t, "renames", renames(p, 1), nil)
+	check(t, "copies", copies(p, 0), []fs.Copy{{Path: "b", Hash: "hash-3", ToRoots: []string{"copy"}}})
+	check(t, "decisions", p.Decisions, []Decision{{Path: "a", Policy: Skip}})
+}
+
+func TestRulesByPattern(t *testing.T) {
+	p := Make([]Snapshot{
+		snapshot("origin", "docs/a.txt", "hash-1", "b.psd", "hash-2", "c", "hash-3"),
+		snapshot("copy", "docs/a.txt", "hash-4", "b.psd", "hash-5", "c", "hash-6"),
+	}, Options{Backup: backup, Policy: Skip, Rules: []Rule{
+		{Pattern: "docs/", Policy: OriginWins},
+		{Pattern: "*.psd", Policy: KeepBoth},
+	}})
+
+	check(t, "decisions", p.Decisions, []Decision{
+		{Path: "b.psd", Policy: KeepBoth, Winner: "origin"},
+		{Path: "c", Policy: Skip},
+		{Path: "docs/a.txt", Policy: OriginWins, Winner: "origin"},
+	})
+	check(t, "renames", renames(p, 1), []fs.Rename{
+		{SourcePath: "b.psd", DestinationPath: "b~hash-5.psd"},
+		{SourcePath: "docs/a.txt", DestinationPath: backup + "/docs/a.txt"},
+	})
+}
+
+func TestAdditiveOnlyAddsFiles(t *testing.T) {
+	p := Make([]Snapshot{
+		snapshot("origin", "dir/moved", "hash-1", "conflict", "hash-2", "new", "hash-3"),
+		snapshot("copy", "moved", "hash-1", "conflict", "hash-4", "deleted", "hash-5"),
+	}, Options{Backup: backup, Additive: true, Policy: NewestWins})
+
+	check(t, "renames", renames(p, 1), nil)
+	check(t, "origin renames", renames(p, 0), nil)
+	check(t, "copies", copies(p, 0), []fs.Copy{
+		{Path: "dir/moved", Hash: "hash-1", ToRoots: []string{"copy"}},
+		{Path: "new", Hash: "hash-3", ToRoots: []string{"copy"}},
+	})
+	check(t, "decisions", p.Decisions, []Decision{{Path: "conflict", Policy: Skip}})
+}
+
+func TestAdditiveCopiesSkippedFilesWhereTheyAreMissing(t *testing.T) {
+	p := Make([]Snapshot{
+		snapshot("origin", "conflict", "hash-1"),
+		snapshot("copy 1", "conflict", "hash-2"),
+		snapshot("copy 2"),
+	}, Options{Backup: backup, Additive: true})
+
+	check(t, "renames", renames(p, 1), nil)
+	check(t, "copies", copies(p, 0), []fs.Copy{{Path: "conflict", Hash: "hash-1", ToRoots: []string{"copy 2"}}})
+	check(t, "decisions", p.Decisions, []Decision{{Path: "conflict", Policy: Skip}})
+}
+
+func TestBidirectionalSpreadsChangesBothWays(t *testing.T) {
+	base := snapshot("", "kept", "hash-1", "deleted", "hash-2", "edited", "hash-3", "renamed", "hash-4")
+	p := Make([]Snapshot{
+		snapshot("a", "kept", "hash-1", "edited", "hash-5", "renamed", "hash-4", "added", "hash-6"),
+		snapshot("b", "kept", "hash-1", "deleted", "hash-2", "edited", "hash-3", "new name", "hash-4"),
+	}, Options{Backup: backup, Bidirectional: true, Base: base.Files})
+
+	check(t, "a renames", renames(p, 0), []fs.Rename{{SourcePath: "renamed", DestinationPath: "new name"}})
+	check(t, "b renames", renames(p, 1), []fs.Rename{
+		{SourcePath: "deleted", DestinationPath: backup + "/deleted"},
+		{SourcePath: "edited", DestinationPath: backup + "/edited"},
+	})
+	check(t, "a copies", copies(p, 0), []fs.Copy{
+		{Path: "added", Hash: "hash-6", ToRoots: []string{"b"}},
+		{Path: "edited", Hash: "hash-5", ToRoots: []string{"b"}},
+	})
+	check(t, "b copies", copies(p, 1), nil)
+	check(t, "decisions", p.Decisions, nil)
+
+	agreed := []string{}
+	for _, file := range p.Agreed {
+		agreed = append(agreed, file.Path)
+	}
+	check(t, "agreed", agreed, []string{"added", "edited", "kept", "new name"})
+}
+
+func TestBidirectionalConcurrentEdits(t *testing.T) {
+	base := snapshot("", "a", "hash-1", "b", "hash-2")
+	newer := snapshot("b", "a", "hash-4", "b", "hash-2")
+	newer.Files[0].ModTime = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	snapshots := []Snapshot{snapshot("a", "a", "hash-3"), newer}
+
+	p := Make(snapshots, Options{Backup: backup, Bidirectional: true, Base: base.Files})
+	check(t, "origin wins", p.Decisions, []Decision{{Path: "a", Policy: OriginWins, Winner: "a"}})
+	check(t, "origin wins copies", copies(p, 0), []fs.Copy{{Path: "a", Hash: "hash-3", ToRoots: []string{"b"}}})
+	check(t, "deletion spreads", renames(p, 1), []fs.Rename{
+		{SourcePath: "b", DestinationPath: backup + "/b"},
+		{SourcePath: "a", DestinationPath: backup + "/a"},
+	})
+
+	p = Make(snapshots, Options{Backup: backup, Bidirectional: true, Base: base.Files, Policy: NewestWins})
+	check(t, "newest wins", p.Decisions, []Decision{{Path: "a", Policy: NewestWins, Winner: "b"}})
+	check(t, "newest wins copies", copies(p, 1), []fs.Copy{{Path: "a", Hash: "hash-4", ToRoots: []string{"a"}}})
+}
+
+func TestBidirectionalOriginIsTheFirstArchiveThatChanged(t *testing.T) {
+	base := snapshot("", "a", "hash-1")
+	p := Make([]Snapshot{
+		snapshot("a", "a", "hash-1"),
+		snapshot("b"),
+		snapshot("c", "a", "hash-2"),
+	}, Options{Backup: backup, Bidirectional: true, Base: base.Files})
+
+	check(t, "decisions", p.Decisions, []Decision{{Path: "a", Policy: OriginWins, Winner: "b"}})
+	check(t, "a renames", renames(p, 0), []fs.Rename{{SourcePath: "a", DestinationPath: backup + "/a"}})
+	check(t, "c renames", renames(p, 2), []fs.Rename{{SourcePath: "a", DestinationPath: backup + "/a"}})
+	check(t, "c copies", copies(p, 2), nil)
+}
+
+func TestFirstBidirectionalSyncUnitesTheArchives(t *testing.T) {
+	p := Make([]Snapshot{
+		snapshot("a", "a", "hash-1", "c", "hash-3"),
+		snapshot("b", "b", "hash-2", "c", "hash-4"),
+	}, Options{Backup: backup, Bidirectional: true, Policy: KeepBoth})
+
+	check(t, "a copies", copies(p, 0), []fs.Copy{{Path: "a", Hash: "hash-1", ToRoots: []string{"b"}}, {Path: "c", Hash: "hash-3", ToRoots: []string{"b"}}})
+	check(t, "b copies", copies(p, 1), []fs.Copy{{Path: "b", Hash: "hash-2", ToRoots: []string{"a"}}, {Path: "c~hash-4", Hash: "hash-4", ToRoots: []string{"a"}}})
+	check(t, "decisions", p.Decisions, []Decision{{Path: "c", Policy: KeepBoth, Winner: "a"}})
+}
+
+func TestNewFilesAreToldFromDeletedOnes(t *testing.T) {
+	snapshots := []Snapshot{
+		snapshot("origin", "a", "hash-1"),
+		snapshot("copy 1", "a", "hash-1", "deleted", "hash-2", "new", "hash-3"),
+		snapshot("copy 2"),
+	}
+	histories := []map[string]bool{nil, {"hash-1": true, "hash-2": true}, nil}
+
+	p := Make(snapshots, Options{Backup: backup, Histories: histories})
+	check(t, "new files", p.NewFiles, []NewFile{{Root: "copy 1", Path: "new", Size: 6, Hash: "hash-3"}})
+	// The new file is not renamed.
+	check(t, "renames", renames(p, 1), []fs.Rename{{SourcePath: "deleted", DestinationPath: backup + "/deleted"}})
+	check(t, "history", p.History, []string{"hash-1"})
+
+	p = Make(snapshots, Options{Backup: backup, Histories: histories, PullNew: true})
+	check(t, "pulled", p.NewFiles, []NewFile{{Root: "copy 1", Path: "new", Size: 6, Hash: "hash-3", Pulled: true}})
+	check(t, "pulled renames", renames(p, 1), []fs.Rename{{SourcePath: "deleted", DestinationPath: backup + "/deleted"}})
+	check(t, "pulled copies", copies(p, 1), []fs.Copy{{Path: "new", Hash: "hash-3", ToRoots: []string{"origin", "copy 2"}}})
+	check(t, "pulled history", p.History, []string{"hash-1", "hash-3"})
+}
@@ -0,0 +1,51 @@
+package plan
+
+import (
+	"slices"
+	"strings"
+
+	"dup/fs"
+)
+
+// Restore plans to copy the files missing from the origin, snapshots[0], back from the copies.
+// A file is missing when the origin has neither its path nor its content; for a copy with a history,
+// only content the origin once had is missing. Only files in one of the paths are restored,
+// all of them when there are none. The first copy holding a file is the one it is restored from,
+// and content held at several paths is restored once, at the first of them.
+func Restore(snapshots []Snapshot, paths []string, histories []map[string]bool) *Plan {
+	origin := snapshots[0]
+	hashes := map[string]bool{}
+	occupied := map[string]bool{}
+	for _, file := range origin.Files {
+		hashes[file.Hash] = true
+		occupied[file.Path] = true
+	}
+
+	result := &Plan{}
+	for i, snapshot := range snapshots {
+		result.Archives = append(result.Archives, Archive{Root: snapshot.Root})
+		result.Fingerprints = append(result.Fingerprints, fs.Fingerprints(snapshot.Files)["."])
+		if i == 0 {
+			continue
+		}
+		var history map[string]bool
+		if i < len(histories) {
+			history = histories[i]
+		}
+		files := slices.Clone(snapshot.Files)
+		slices.SortFunc(files, func(a, b fs.FileMeta) int { return strings.Compare(a.Path, b.Path) })
+		for _, file := range files {
+			if occupied[file.Path] || hashes[file.Hash] || history != nil && !history[file.Hash] ||
+				len(paths) > 0 && !slices.ContainsFunc(paths, func(dir string) bool { return fs.InDir(file.Path, dir) }) {
+				continue
+			}
+			occupied[file.Path] = true
+			hashes[file.Hash] = true
+			result.Archives[i].Copies = append(result.Archives[i].Copies, Copy{
+				Copy: fs.Copy{Path: file.Path, Hash: file.Hash, ToRoots: []string{origin.Root}},
+				Size: file.Size,
+			})
+		}
+	}
+	return result
+}
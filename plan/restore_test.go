@@ -0,0 +1,42 @@
+package plan
+
+import (
+	"testing"
+
+	"dup/fs"
+)
+
+func TestRestoreMissingFiles(t *testing.T) {
+	snapshots := []Snapshot{
+		snapshot("origin", "kept", "hash-1", "moved", "hash-2", "conflict", "hash-3"),
+		snapshot("copy 1", "kept", "hash-1", "dir/moved", "hash-2", "conflict", "hash-4", "dir/lost", "hash-5"),
+		snapshot("copy 2", "dir/lost", "hash-6", "lost", "hash-7", "new", "hash-8"),
+	}
+	histories := []map[string]bool{nil, nil, {"hash-7": true}}
+
+	p := Restore(snapshots, nil, histories)
+	check(t, "copy 1", copies(p, 1), []fs.Copy{{Path: "dir/lost", Hash: "hash-5", ToRoots: []string{"origin"}}})
+	check(t, "copy 2", copies(p, 2), []fs.Copy{{Path: "lost", Hash: "hash-7", ToRoots: []string{"origin"}}})
+
+	p = Restore(snapshots, []string{"dir"}, histories)
+	check(t, "subtree copy 1", copies(p, 1), []fs.Copy{{Path: "dir/lost", Hash: "hash-5", ToRoots: []string{"origin"}}})
+	check(t, "subtree copy 2", copies(p, 2), nil)
+}
+
+func TestRestoreFromSeveralCopies(t *testing.T) {
+	snapshots := []Snapshot{
+		snapshot("origin", "kept", "hash-1"),
+		// The first copy is missing, as an unplugged disk is.
+		snapshot("copy 1"),
+		snapshot("copy 2", "a", "hash-2", "backup/a", "hash-2", "b", "hash-3"),
+		snapshot("copy 3", "a", "hash-2", "c", "hash-2", "b", "hash-4", "d", "hash-5"),
+	}
+
+	p := Restore(snapshots, nil, nil)
+	check(t, "copy 1", copies(p, 1), nil)
+	check(t, "copy 2", copies(p, 2), []fs.Copy{
+		{Path: "a", Hash: "hash-2", ToRoots: []string{"origin"}},
+		{Path: "b", Hash: "hash-3", ToRoots: []string{"origin"}},
+	})
+	check(t, "copy 3", copies(p, 3), []fs.Copy{{Path: "d", Hash: "hash-5", ToRoots: []string{"origin"}}})
+}